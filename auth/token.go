@@ -0,0 +1,122 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package auth implements the stateless signed subscribe token. A token is
+// "base64url(payload).base64url(hmac-sha256(secret, base64url(payload)))",
+// the payload is a json:
+// {"key":"Terry-Mao","exp":1400000000,"iat":1399990000,"scopes":["sub"]}.
+// The secrets can be rotated by verifying with both the old and new secrets.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	tokenSpliter = "."
+	// subscribe scope
+	ScopeSub = "sub"
+)
+
+var (
+	ErrTokenFormat  = errors.New("signed token format error")
+	ErrTokenSign    = errors.New("signed token signature error")
+	ErrTokenExpired = errors.New("signed token expired")
+	ErrNoSecret     = errors.New("no secret")
+	encoding        = base64.RawURLEncoding
+)
+
+// Claims is the payload of a signed token.
+type Claims struct {
+	Key    string   `json:"key"`              // subscriber key
+	Expire int64    `json:"exp"`              // expire unix time in seconds
+	Issued int64    `json:"iat,omitempty"`    // issued unix time in seconds
+	Scopes []string `json:"scopes,omitempty"` // empty means all the scopes
+}
+
+// HasScope check the claims has the scope.
+func (c *Claims) HasScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// sign get the signature of the encoded payload.
+func sign(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return encoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign create a signed token of the claims.
+func Sign(secret string, c *Claims) (string, error) {
+	if secret == "" {
+		return "", ErrNoSecret
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := encoding.EncodeToString(data)
+	return payload + tokenSpliter + sign(secret, payload), nil
+}
+
+// Verify verify the signed token by any of the secrets, return the claims
+// if the signature is valid and not expired.
+func Verify(secrets []string, token string) (*Claims, error) {
+	if len(secrets) == 0 {
+		return nil, ErrNoSecret
+	}
+	i := strings.Index(token, tokenSpliter)
+	if i < 0 {
+		return nil, ErrTokenFormat
+	}
+	payload, signature := token[:i], token[i+1:]
+	valid := false
+	for _, secret := range secrets {
+		if secret != "" && hmac.Equal([]byte(sign(secret, payload)), []byte(signature)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrTokenSign
+	}
+	data, err := encoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrTokenFormat
+	}
+	c := &Claims{}
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, ErrTokenFormat
+	}
+	if time.Now().Unix() >= c.Expire {
+		return nil, ErrTokenExpired
+	}
+	return c, nil
+}
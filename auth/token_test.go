@@ -0,0 +1,86 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	token, err := Sign("secret1", &Claims{Key: "Terry-Mao", Expire: exp, Scopes: []string{ScopeSub}})
+	if err != nil {
+		t.Fatalf("Sign() error(%v)", err)
+	}
+	c, err := Verify([]string{"secret1"}, token)
+	if err != nil {
+		t.Fatalf("Verify() error(%v)", err)
+	}
+	if c.Key != "Terry-Mao" || c.Expire != exp {
+		t.Errorf("claims error: %v", c)
+	}
+	if !c.HasScope(ScopeSub) || c.HasScope("pub") {
+		t.Errorf("scopes error: %v", c.Scopes)
+	}
+	// rotated secrets
+	if _, err = Verify([]string{"secret2", "secret1"}, token); err != nil {
+		t.Errorf("Verify() rotated error(%v)", err)
+	}
+	if _, err = Verify([]string{"secret2"}, token); err != ErrTokenSign {
+		t.Errorf("Verify() wrong secret error(%v)", err)
+	}
+	if _, err = Verify([]string{"secret1"}, token+"a"); err != ErrTokenSign {
+		t.Errorf("Verify() tampered error(%v)", err)
+	}
+	if _, err = Verify([]string{"secret1"}, "abc"); err != ErrTokenFormat {
+		t.Errorf("Verify() format error(%v)", err)
+	}
+	if _, err = Verify(nil, token); err != ErrNoSecret {
+		t.Errorf("Verify() no secret error(%v)", err)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	token, err := Sign("secret", &Claims{Key: "Terry-Mao", Expire: time.Now().Add(-time.Second).Unix()})
+	if err != nil {
+		t.Fatalf("Sign() error(%v)", err)
+	}
+	if _, err = Verify([]string{"secret"}, token); err != ErrTokenExpired {
+		t.Errorf("Verify() expired error(%v)", err)
+	}
+	// empty scopes means all
+	c := &Claims{}
+	if !c.HasScope(ScopeSub) {
+		t.Error("empty scopes should have all the scopes")
+	}
+}
+
+func TestIssued(t *testing.T) {
+	iat := time.Now().Unix()
+	token, err := Sign("secret", &Claims{Key: "Terry-Mao", Expire: iat + 3600, Issued: iat})
+	if err != nil {
+		t.Fatalf("Sign() error(%v)", err)
+	}
+	c, err := Verify([]string{"secret"}, token)
+	if err != nil {
+		t.Fatalf("Verify() error(%v)", err)
+	}
+	if c.Issued != iat {
+		t.Errorf("claims issued %d, want %d", c.Issued, iat)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package cert
+
+import (
+	log "github.com/alecthomas/log4go"
+	"crypto/tls"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrCert = errors.New("tls certificate not loaded")
+)
+
+// Cert hold the current tls certificate, it can be replaced at runtime, the
+// new handshakes use the new certificate and the established connections are
+// not affected.
+type Cert struct {
+	cert  *tls.Certificate
+	mutex *sync.RWMutex
+}
+
+// New new a empty Cert.
+func New() *Cert {
+	return &Cert{mutex: &sync.RWMutex{}}
+}
+
+// Load read the certificate and key files.
+func Load(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Error("tls.LoadX509KeyPair(\"%s\", \"%s\") error(%v)", certFile, keyFile, err)
+		return nil, err
+	}
+	log.Info("load tls certificate: \"%s\"", certFile)
+	return &cert, nil
+}
+
+// LoadIf read the certificate and key files if any tls listener bound,
+// return nil if not, so the files are not required without tls.
+func LoadIf(binds bool, certFile, keyFile string) (*tls.Certificate, error) {
+	if !binds {
+		return nil, nil
+	}
+	return Load(certFile, keyFile)
+}
+
+// Set replace the current certificate, nil is ignored.
+func (c *Cert) Set(cert *tls.Certificate) {
+	if cert == nil {
+		return
+	}
+	c.mutex.Lock()
+	c.cert = cert
+	c.mutex.Unlock()
+}
+
+// GetCertificate return the current certificate for the tls handshake.
+func (c *Cert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.cert == nil {
+		return nil, ErrCert
+	}
+	return c.cert, nil
+}
+
+// Config create a tls config which always use the current certificate.
+func (c *Cert) Config() *tls.Config {
+	return &tls.Config{GetCertificate: c.GetCertificate}
+}
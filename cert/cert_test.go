@@ -0,0 +1,51 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package cert
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestCert(t *testing.T) {
+	if _, err := Load("./not_exist.pem", "./not_exist.key"); err == nil {
+		t.Error("Load() not exist files succeed")
+	}
+	// the files are not read without any tls listener
+	if cert, err := LoadIf(false, "./not_exist.pem", "./not_exist.key"); err != nil || cert != nil {
+		t.Errorf("LoadIf(false) error(%v)", err)
+	}
+	if _, err := LoadIf(true, "./not_exist.pem", "./not_exist.key"); err == nil {
+		t.Error("LoadIf(true) not exist files succeed")
+	}
+	c := New()
+	conf := c.Config()
+	if _, err := conf.GetCertificate(nil); err != ErrCert {
+		t.Errorf("GetCertificate() error(%v)", err)
+	}
+	a, b := &tls.Certificate{}, &tls.Certificate{}
+	c.Set(a)
+	c.Set(nil)
+	if cert, err := conf.GetCertificate(nil); err != nil || cert != a {
+		t.Errorf("GetCertificate() error(%v)", err)
+	}
+	// the tls config use the replaced certificate
+	c.Set(b)
+	if cert, err := conf.GetCertificate(nil); err != nil || cert != b {
+		t.Errorf("GetCertificate() error(%v)", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"time"
+)
+
+// unacked private message.
+type unackedMsg struct {
+	m     *myrpc.Message
+	msg   []byte
+	retry int
+	timer *time.Timer
+}
+
+// WriteAck write the private message to client and track it till acked, if
+// not acked in Conf().AckTimeout then redeliver it.
+func (c *Connection) WriteAck(key string, m *myrpc.Message, msg []byte) {
+	// the spilled connection gets the message from the offline storage
+	if Conf().AckTimeout <= 0 || c.Spilled() || !c.canAck() {
+		c.Write(key, m, msg)
+		return
+	}
+	mid := m.MsgId
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	if c.closed {
+		return
+	}
+	if _, ok := c.unacked[mid]; !ok {
+		um := &unackedMsg{m: m, msg: msg, retry: 0}
+		um.timer = time.AfterFunc(Conf().AckTimeout, func() { c.redeliver(key, mid) })
+		c.unacked[mid] = um
+	}
+	c.Write(key, m, msg)
+}
+
+// canAck check the connection protocol can send the ack, the sse and
+// long-poll connections are read only, their private messages are not
+// tracked and left in the storage till expired.
+func (c *Connection) canAck() bool {
+	return c.Proto != SSEProto && c.Proto != LongPollProto
+}
+
+// redeliver write the unacked message again, discard it after Conf().AckRetry
+// times.
+func (c *Connection) redeliver(key string, mid int64) {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	if c.closed {
+		return
+	}
+	um, ok := c.unacked[mid]
+	if !ok {
+		return
+	}
+	if um.retry >= Conf().AckRetry {
+		delete(c.unacked, mid)
+		MsgStat.IncrUnacked(1)
+		log.Warn("user_key:\"%s\" mid:%d not acked after %d redelivery, discard", key, mid, um.retry)
+		return
+	}
+	um.retry++
+	um.timer.Reset(Conf().AckTimeout)
+	MsgStat.IncrRedelivered(1)
+	log.Debug("user_key:\"%s\" redeliver mid:%d (%d)", key, mid, um.retry)
+	c.Write(key, um.m, um.msg)
+}
+
+// Ack stop tracking the acked message, return false if the message not
+// tracked by the connection.
+func (c *Connection) Ack(key string, mid int64) bool {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	um, ok := c.unacked[mid]
+	if !ok {
+		return false
+	}
+	um.timer.Stop()
+	delete(c.unacked, mid)
+	MsgStat.IncrDelivered(1)
+	log.Debug("user_key:\"%s\" ack mid:%d", key, mid)
+	return true
+}
+
+// Unacked check the message is still tracked by the connection.
+func (c *Connection) Unacked(mid int64) bool {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	_, ok := c.unacked[mid]
+	return ok
+}
+
+// CloseAck stop all the redelivery timers, must called before the connection
+// buf closed. The unacked messages are still stored, client can get them as
+// offline messages.
+func (c *Connection) CloseAck() {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	for _, um := range c.unacked {
+		um.timer.Stop()
+	}
+	c.unacked = nil
+	c.closed = true
+}
+
+// ackPrivate delete the acked private message from the message storage.
+func ackPrivate(key string, mid int64) error {
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		return ErrMessageRPC
+	}
+	args := &myrpc.MessageAckPrivateArgs{Key: key, MsgId: mid}
+	ret := 0
+	if err := client.Call(myrpc.MessageServiceAckPrivate, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceAckPrivate, args, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"math/rand"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	// external auth verifier protocols
+	AuthExternalHTTP = "http"
+	AuthExternalRPC  = "rpc"
+)
+
+var (
+	ErrAuthRPC      = errors.New("Auth RPC not init")
+	ErrAuthExternal = errors.New("unknown external auth protocol")
+	ErrAuthDenied   = errors.New("external auth denied")
+	ErrAuthTimeout  = errors.New("external auth timeout")
+	authHTTPClient  *http.Client
+	authCache       = newAuthResultCache()
+)
+
+// InitAuth init the external auth verifier, only used when the auth mode is
+// "external".
+func InitAuth() error {
+	if !Conf().Auth || Conf().AuthMode != AuthModeExternal {
+		return nil
+	}
+	if len(Conf().AuthExternalAddr) == 0 {
+		log.Warn("no external auth addr, all the subscribers will be rejected")
+		return nil
+	}
+	switch Conf().AuthExternalProto {
+	case AuthExternalHTTP:
+		authHTTPClient = &http.Client{Timeout: Conf().AuthExternalTimeout}
+		return nil
+	case AuthExternalRPC:
+		myrpc.InitAuth(Conf().AuthExternalAddr, Conf().RPCRetry, Conf().RPCPing)
+		return nil
+	}
+	return ErrAuthExternal
+}
+
+// authExternal verify the token of the key by the external verifier, the
+// result is cached for a while, return the connection attributes.
+func authExternal(key, token string) (map[string]string, error) {
+	ck := authCacheKey{key: key, token: token}
+	if r, ok := authCache.Get(ck); ok {
+		if !r.Ok {
+			return nil, ErrAuthDenied
+		}
+		return r.Attrs, nil
+	}
+	args := &myrpc.AuthArgs{Key: key, Token: token, Node: Conf().ZookeeperCometNode}
+	r := &myrpc.AuthReply{}
+	var err error
+	if Conf().AuthExternalProto == AuthExternalRPC {
+		err = authRPC(args, r)
+	} else {
+		err = authHTTP(args, r)
+	}
+	// the verifier failures are not cached
+	if err != nil {
+		return nil, err
+	}
+	if r.Ok {
+		authCache.Set(ck, r, Conf().AuthCacheExpire)
+		return r.Attrs, nil
+	}
+	authCache.Set(ck, r, Conf().AuthNegCacheExpire)
+	return nil, ErrAuthDenied
+}
+
+// authRPC call the "AuthRPC.Verify" in Conf().AuthExternalTimeout, the reply
+// must not be used if timeout.
+func authRPC(args *myrpc.AuthArgs, r *myrpc.AuthReply) error {
+	client := myrpc.AuthRPC.Get()
+	if client == nil {
+		return ErrAuthRPC
+	}
+	timer := time.NewTimer(Conf().AuthExternalTimeout)
+	defer timer.Stop()
+	call := client.Go(myrpc.AuthServiceVerify, args, r, make(chan *rpc.Call, 1))
+	select {
+	case call = <-call.Done:
+		if call.Error != nil {
+			log.Error("client.Go(\"%s\", \"%v\", r) error(%v)", myrpc.AuthServiceVerify, args, call.Error)
+			return call.Error
+		}
+	case <-timer.C:
+		log.Error("client.Go(\"%s\", \"%v\", r) error(%v)", myrpc.AuthServiceVerify, args, ErrAuthTimeout)
+		return ErrAuthTimeout
+	}
+	return nil
+}
+
+// authHTTP post the args as json to a random verifier url, the verifier must
+// reply 200 and a json like {"ok":true,"attrs":{"uid":"1"}}.
+func authHTTP(args *myrpc.AuthArgs, r *myrpc.AuthReply) error {
+	if authHTTPClient == nil || len(Conf().AuthExternalAddr) == 0 {
+		return ErrAuthRPC
+	}
+	url := Conf().AuthExternalAddr[rand.Intn(len(Conf().AuthExternalAddr))]
+	body, err := json.Marshal(args)
+	if err != nil {
+		log.Error("json.Marshal(\"%v\") error(%v)", args, err)
+		return err
+	}
+	resp, err := authHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("http.Post(\"%s\") error(%v)", url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("http status code %d", resp.StatusCode)
+		log.Error("http.Post(\"%s\") error(%v)", url, err)
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(r); err != nil {
+		log.Error("json.Decode(\"%s\") error(%v)", url, err)
+		return err
+	}
+	return nil
+}
+
+// authCacheKey is the key of a cached result, the subscriber key and token
+// are compared separately, so no pairs collide.
+type authCacheKey struct {
+	key   string
+	token string
+}
+
+// cached external auth result
+type authResult struct {
+	key    authCacheKey
+	reply  *myrpc.AuthReply
+	expire time.Time
+}
+
+// authResultCache is a lru cache of the external auth results, the oldest
+// results are evicted when it's full.
+type authResultCache struct {
+	mutex *sync.Mutex
+	data  map[authCacheKey]*list.Element
+	lru   *list.List
+}
+
+// newAuthResultCache create a external auth result cache.
+func newAuthResultCache() *authResultCache {
+	return &authResultCache{
+		mutex: &sync.Mutex{},
+		data:  map[authCacheKey]*list.Element{},
+		lru:   list.New(),
+	}
+}
+
+// Get get a not expired result.
+func (c *authResultCache) Get(key authCacheKey) (*myrpc.AuthReply, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.data[key]
+	if !ok {
+		return nil, false
+	}
+	r := e.Value.(*authResult)
+	if time.Now().After(r.expire) {
+		delete(c.data, key)
+		c.lru.Remove(e)
+		return nil, false
+	}
+	// the recently used result is evicted last
+	c.lru.MoveToBack(e)
+	return r.reply, true
+}
+
+// DeleteKey delete all the results of the subscriber key.
+func (c *authResultCache) DeleteKey(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k, e := range c.data {
+		if k.key == key {
+			delete(c.data, k)
+			c.lru.Remove(e)
+		}
+	}
+}
+
+// Set add or replace a result, zero expire means no cache.
+func (c *authResultCache) Set(key authCacheKey, reply *myrpc.AuthReply, expire time.Duration) {
+	if expire <= 0 || Conf().AuthCacheSize <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.data[key]; ok {
+		delete(c.data, key)
+		c.lru.Remove(e)
+	}
+	c.data[key] = c.lru.PushBack(&authResult{key: key, reply: reply, expire: time.Now().Add(expire)})
+	for c.lru.Len() > Conf().AuthCacheSize {
+		e := c.lru.Front()
+		delete(c.data, e.Value.(*authResult).key)
+		c.lru.Remove(e)
+	}
+}
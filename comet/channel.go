@@ -20,16 +20,19 @@ import (
 	log "github.com/alecthomas/log4go"
 	"errors"
 	"github.com/Terry-Mao/gopush-cluster/hash"
+	"github.com/Terry-Mao/gopush-cluster/heap"
 	"github.com/Terry-Mao/gopush-cluster/hlist"
 	"github.com/Terry-Mao/gopush-cluster/ketama"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	"sync"
+	"time"
 )
 
 var (
 	ErrChannelNotExist = errors.New("Channle not exist")
 	ErrConnProto       = errors.New("Unknown connection protocol")
 	ErrChannelKey      = errors.New("Key not belong this comet")
+	ErrChannelAuth     = errors.New("Channel auth failed")
 	UserChannel        *ChannelList
 	CometRing          *ketama.HashRing
 	nodeWeightMap      = map[string]int{}
@@ -44,22 +47,40 @@ type Channel interface {
 	// Add a token for one subscriber
 	// The request token not equal the subscriber token will return errors.
 	AddToken(key, token string) error
-	// Auth auth the access token.
+	// Auth auth the access token, return the connection attributes got by
+	// the external auth.
 	// The request token not match the subscriber token will return errors.
-	AuthToken(key, token string) bool
+	AuthToken(key, token string) (map[string]string, bool)
 	// AddConn add a connection for the subscriber.
 	// Exceed the max number of subscribers per key will return errors.
 	AddConn(key string, conn *Connection) (*hlist.Element, error)
 	// RemoveConn remove a connection for the  subscriber.
 	RemoveConn(key string, e *hlist.Element) error
+	// Redirect tell the connections reconnect to the new node address.
+	// nil addr means reconnect to any node.
+	Redirect(key string, addr *myrpc.CometNodeAddr) error
+	// Kick send the reason to the connections of the subscriber then close
+	// them, the registered tokens are revoked if revoke is true.
+	Kick(key, reason string, revoke bool) error
+	// Online get the connection count and protocols of the subscriber.
+	Online() *myrpc.CometOnline
+	// ExpireIdle mark the channel expired if it has no connection and valid
+	// token for ttl, otherwise return the time it may expire.
+	ExpireIdle(ttl time.Duration) (time.Time, bool)
+	// Flushed check all the pending messages of the connections are sent.
+	Flushed() bool
+	// Unacked check any connection of the subscriber still waits the ack of
+	// the private message.
+	Unacked(mid int64) bool
 	// Expire expire the channle and clean data.
 	Close() error
 }
 
 // Channel bucket.
 type ChannelBucket struct {
-	Data  map[string]Channel
-	mutex *sync.Mutex
+	Data   map[string]Channel
+	mutex  *sync.Mutex
+	expire *heap.Minheap // idle expiration schedule, keyed by unix second
 }
 
 // Channel list.
@@ -81,11 +102,12 @@ func (c *ChannelBucket) Unlock() {
 func NewChannelList() *ChannelList {
 	l := &ChannelList{Channels: []*ChannelBucket{}}
 	// split hashmap to many bucket
-	log.Debug("create %d ChannelBucket", Conf.ChannelBucket)
-	for i := 0; i < Conf.ChannelBucket; i++ {
+	log.Debug("create %d ChannelBucket", Conf().ChannelBucket)
+	for i := 0; i < Conf().ChannelBucket; i++ {
 		c := &ChannelBucket{
-			Data:  map[string]Channel{},
-			mutex: &sync.Mutex{},
+			Data:   map[string]Channel{},
+			mutex:  &sync.Mutex{},
+			expire: heap.NewMinheap(expireHeapSize),
 		}
 		l.Channels = append(l.Channels, c)
 	}
@@ -95,7 +117,7 @@ func NewChannelList() *ChannelList {
 // Count get the bucket total channel count.
 func (l *ChannelList) Count() int {
 	c := 0
-	for i := 0; i < Conf.ChannelBucket; i++ {
+	for i := 0; i < Conf().ChannelBucket; i++ {
 		c += len(l.Channels[i].Data)
 	}
 	return c
@@ -105,7 +127,7 @@ func (l *ChannelList) Count() int {
 func (l *ChannelList) Bucket(key string) *ChannelBucket {
 	h := hash.NewMurmur3C()
 	h.Write([]byte(key))
-	idx := uint(h.Sum32()) & uint(Conf.ChannelBucket-1)
+	idx := uint(h.Sum32()) & uint(Conf().ChannelBucket-1)
 	log.Debug("user_key:\"%s\" hit channel bucket index:%d", key, idx)
 	return l.Channels[idx]
 }
@@ -117,9 +139,9 @@ func (l *ChannelList) validate(key string) error {
 		return ErrChannelKey
 	}
 	node := CometRing.Hash(key)
-	log.Debug("match node:%s hash node:%s", Conf.ZookeeperCometNode, node)
-	if Conf.ZookeeperCometNode != node {
-		log.Warn("user_key:\"%s\" node:%s not match this node:%s", key, node, Conf.ZookeeperCometNode)
+	log.Debug("match node:%s hash node:%s", Conf().ZookeeperCometNode, node)
+	if Conf().ZookeeperCometNode != node {
+		log.Warn("user_key:\"%s\" node:%s not match this node:%s", key, node, Conf().ZookeeperCometNode)
 		return ErrChannelKey
 	}
 	return nil
@@ -142,6 +164,7 @@ func (l *ChannelList) New(key string) (Channel, *ChannelBucket, error) {
 	} else {
 		c = NewSeqChannel()
 		b.Data[key] = c
+		b.schedule(key, c, time.Now().Add(Conf().ChannelIdleExpire))
 		b.Unlock()
 		ChStat.IncrCreate()
 		log.Info("user_key:\"%s\" create a new channel", key)
@@ -159,9 +182,12 @@ func (l *ChannelList) Get(key string, newOne bool) (Channel, error) {
 	b := l.Bucket(key)
 	b.Lock()
 	if c, ok := b.Data[key]; !ok {
-		if !Conf.Auth && newOne {
+		// the registered token needs a existing channel, the stateless
+		// tokens are verified by GetAuth before the channel created
+		if newOne && (!Conf().Auth || Conf().AuthMode != AuthModeToken) {
 			c = NewSeqChannel()
 			b.Data[key] = c
+			b.schedule(key, c, time.Now().Add(Conf().ChannelIdleExpire))
 			b.Unlock()
 			ChStat.IncrCreate()
 			log.Info("user_key:\"%s\" create a new channel", key)
@@ -179,6 +205,49 @@ func (l *ChannelList) Get(key string, newOne bool) (Channel, error) {
 	}
 }
 
+// GetAuth get the channel of the subscriber and auth the token, return the
+// connection attributes. The signed and external tokens need no channel
+// state, so they're verified before the channel of a fresh key created.
+func (l *ChannelList) GetAuth(key, token string) (Channel, map[string]string, error) {
+	if err := l.validate(key); err != nil {
+		return nil, nil, err
+	}
+	if Conf().Auth && Conf().AuthMode != AuthModeToken {
+		attrs, err := authStateless(key, token)
+		if err != nil {
+			log.Error("user_key:\"%s\" auth %s token \"%s\" error(%v)", key, Conf().AuthMode, token, err)
+			return nil, nil, ErrChannelAuth
+		}
+		c, err := l.Get(key, true)
+		return c, attrs, err
+	}
+	c, err := l.Get(key, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs, ok := c.AuthToken(key, token)
+	if !ok {
+		return nil, nil, ErrChannelAuth
+	}
+	return c, attrs, nil
+}
+
+// AddConn add the connection to the channel got by Get or GetAuth, the
+// channel evicted by the idle expiry between them is got (or created) again
+// once, return the channel the connection added to.
+func (l *ChannelList) AddConn(key string, c Channel, conn *Connection) (Channel, *hlist.Element, error) {
+	e, err := c.AddConn(key, conn)
+	if err != ErrChannelExpired {
+		return c, e, err
+	}
+	log.Warn("user_key:\"%s\" channel expired before adding conn, retry", key)
+	if c, err = l.Get(key, true); err != nil {
+		return nil, nil, err
+	}
+	e, err = c.AddConn(key, conn)
+	return c, e, err
+}
+
 // Delete a user channel from ChannleList.
 func (l *ChannelList) Delete(key string) (Channel, error) {
 	// get a channel bucket
@@ -197,6 +266,29 @@ func (l *ChannelList) Delete(key string) (Channel, error) {
 	}
 }
 
+// All get all the channels.
+func (l *ChannelList) All() map[string]Channel {
+	chs := make(map[string]Channel, l.Count())
+	for _, b := range l.Channels {
+		b.Lock()
+		for k, c := range b.Data {
+			chs[k] = c
+		}
+		b.Unlock()
+	}
+	return chs
+}
+
+// Flushed check all the pending messages of the channels are sent.
+func (l *ChannelList) Flushed() bool {
+	for _, c := range l.All() {
+		if !c.Flushed() {
+			return false
+		}
+	}
+	return true
+}
+
 // Close close all channel.
 func (l *ChannelList) Close() {
 	log.Info("channel close")
@@ -216,8 +308,9 @@ func (l *ChannelList) Close() {
 	}
 }
 
-// Migrate migrate portion of connections which don't belong to this comet.
-func (l *ChannelList) Migrate(nw map[string]int) (err error) {
+// Migrate migrate portion of connections which don't belong to this comet,
+// the connections are redirected to the new node then closed in batches.
+func (l *ChannelList) Migrate(nw map[string]int, addrs map[string]*myrpc.CometNodeAddr) (err error) {
 	migrate := false
 	// check new/update node
 	for k, v := range nw {
@@ -251,13 +344,13 @@ func (l *ChannelList) Migrate(nw map[string]int) (err error) {
 	nodeWeightMap = nw
 	CometRing = ring
 	// get all the channel lock
-	channels := []Channel{}
+	channels := map[string]Channel{}
 	for i, c := range l.Channels {
 		c.Lock()
 		for k, v := range c.Data {
 			hn := ring.Hash(k)
-			if hn != Conf.ZookeeperCometNode {
-				channels = append(channels, v)
+			if hn != Conf().ZookeeperCometNode {
+				channels[k] = v
 				delete(c.Data, k)
 				log.Debug("migrate delete channel key \"%s\"", k)
 			}
@@ -265,14 +358,27 @@ func (l *ChannelList) Migrate(nw map[string]int) (err error) {
 		c.Unlock()
 		log.Debug("migrate channel bucket:%d finished", i)
 	}
-	// close all the migrate channels
+	// spread the closes over time, avoid reconnect storm
+	go migrateClose(ring, channels, addrs)
+	return
+}
+
+// migrateClose redirect and close the migrate channels in batches.
+func migrateClose(ring *ketama.HashRing, channels map[string]Channel, addrs map[string]*myrpc.CometNodeAddr) {
 	log.Info("close all the migrate channels")
-	for _, channel := range channels {
+	n := 0
+	for key, channel := range channels {
+		if addr, ok := addrs[ring.Hash(key)]; ok {
+			if err := channel.Redirect(key, addr); err != nil {
+				log.Error("channel.Redirect(\"%s\") error(%v)", key, err)
+			}
+		}
 		if err := channel.Close(); err != nil {
 			log.Error("channel.Close() error(%v)", err)
-			continue
+		}
+		if n++; Conf().MigrateBatch > 0 && n%Conf().MigrateBatch == 0 {
+			time.Sleep(Conf().MigrateInterval)
 		}
 	}
 	log.Info("close all the migrate channels finished")
-	return
 }
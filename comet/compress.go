@@ -0,0 +1,145 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"strings"
+	"sync"
+)
+
+const (
+	// message encodings of a connection
+	EncodingNone      = uint8(0)
+	EncodingDeflate   = uint8(1)
+	EncodingWSDeflate = uint8(2) // websocket permessage-deflate (RFC 7692)
+	// capabilities sent by client when subscribing
+	capSpliter = ","
+	// the application level message encoding, the message payload is raw
+	// deflated by comet and inflated by the client. The websocket clients
+	// can negotiate the permessage-deflate extension (RFC 7692) by the
+	// handshake instead, see websocket_deflate.go
+	CapDeflate = "msg-deflate"
+	// binary protocol frame flags
+	FlagDeflate = uint16(1)
+)
+
+var (
+	flateWriterPool = sync.Pool{
+		New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.BestSpeed)
+			return w
+		},
+	}
+)
+
+// parseCaps get the message encoding by the client capabilities, eg:
+// "msg-deflate".
+func parseCaps(caps string) uint8 {
+	if !Conf().Compress || caps == "" {
+		return EncodingNone
+	}
+	for _, c := range strings.Split(caps, capSpliter) {
+		if strings.TrimSpace(c) == CapDeflate {
+			return EncodingDeflate
+		}
+	}
+	return EncodingNone
+}
+
+// deflate compress the data by raw deflate (RFC 1951).
+func deflate(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// wsDeflate compress the data as a permessage-deflate message, the deflate
+// stream is sync flushed and the "0x00 0x00 0xff 0xff" tail is stripped.
+func wsDeflate(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), wsDeflateTail[:4]), nil
+}
+
+// msgEncoder encode a message for the connections, the message is serialized
+// and compressed only once per version and encoding.
+type msgEncoder struct {
+	m *myrpc.Message
+	// [old version, new version][encoding]
+	cache [2][3][]byte
+}
+
+// newMsgEncoder create a encoder for the message.
+func newMsgEncoder(m *myrpc.Message) *msgEncoder {
+	return &msgEncoder{m: m}
+}
+
+// Bytes get the message bytes for the connection.
+func (e *msgEncoder) Bytes(conn *Connection) (msg []byte, err error) {
+	ver := 1
+	// if version empty then use old protocol
+	if conn.Version == "" {
+		ver = 0
+	}
+	if msg = e.cache[ver][EncodingNone]; msg == nil {
+		if ver == 0 {
+			msg, err = e.m.OldBytes()
+		} else {
+			msg, err = e.m.Bytes()
+		}
+		if err != nil {
+			return
+		}
+		e.cache[ver][EncodingNone] = msg
+	}
+	if conn.Encoding == EncodingNone {
+		return
+	}
+	raw := msg
+	if msg = e.cache[ver][conn.Encoding]; msg == nil {
+		if conn.Encoding == EncodingWSDeflate {
+			msg, err = wsDeflate(raw)
+		} else {
+			msg, err = deflate(raw)
+		}
+		if err != nil {
+			return
+		}
+		e.cache[ver][conn.Encoding] = msg
+	}
+	MsgStat.IncrCompressed(uint64(len(raw)), uint64(len(msg)))
+	return
+}
@@ -17,15 +17,42 @@
 package main
 
 import (
+	log "github.com/alecthomas/log4go"
+	"crypto/tls"
 	"flag"
 	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gopush-cluster/reload"
 	"runtime"
 	"time"
 )
 
 var (
-	Conf     *Config
+	// the current config, replaced when reloading
+	liveConf *reload.Config
 	confFile string
+	// the settings can be applied at runtime
+	hotConf = map[string]bool{
+		"Log":                     true,
+		"ZookeeperCometWeight":    true,
+		"TokenExpire":             true,
+		"AuthSecrets":             true,
+		"AuthCacheExpire":         true,
+		"AuthNegCacheExpire":      true,
+		"AuthCacheSize":           true,
+		"MaxSubscriberPerChannel": true,
+		"MsgBufNum":               true,
+		"MaxTopicPerConn":         true,
+		"AckTimeout":              true,
+		"AckRetry":                true,
+		"MigrateBatch":            true,
+		"MigrateInterval":         true,
+		"SlowPolicy":              true,
+		"TLSCertFile":             true,
+		"TLSKeyFile":              true,
+		"Compress":                true,
+		"DrainTimeout":            true,
+		"UpstreamTimeout":         true,
+	}
 )
 
 func init() {
@@ -34,16 +61,24 @@ func init() {
 
 type Config struct {
 	// base
-	User          string   `goconf:"base:user"`
-	PidFile       string   `goconf:"base:pidfile"`
-	Dir           string   `goconf:"base:dir"`
-	Log           string   `goconf:"base:log"`
-	MaxProc       int      `goconf:"base:maxproc"`
-	TCPBind       []string `goconf:"base:tcp.bind:,"`
-	WebsocketBind []string `goconf:"base:websocket.bind:,"`
-	RPCBind       []string `goconf:"base:rpc.bind:,"`
-	PprofBind     []string `goconf:"base:pprof.bind:,"`
-	StatBind      []string `goconf:"base:stat.bind:,"`
+	User             string        `goconf:"base:user"`
+	PidFile          string        `goconf:"base:pidfile"`
+	Dir              string        `goconf:"base:dir"`
+	Log              string        `goconf:"base:log"`
+	MaxProc          int           `goconf:"base:maxproc"`
+	TCPBind          []string      `goconf:"base:tcp.bind:,"`
+	WebsocketBind    []string      `goconf:"base:websocket.bind:,"`
+	TCPTLSBind       []string      `goconf:"base:tcp.tls.bind:,"`
+	TCPV2Bind        []string      `goconf:"base:tcp.v2.bind:,"`
+	SSEBind          []string      `goconf:"base:sse.bind:,"`
+	LongPollBind     []string      `goconf:"base:longpoll.bind:,"`
+	WebsocketTLSBind []string      `goconf:"base:websocket.tls.bind:,"`
+	TLSCertFile      string        `goconf:"base:tls.cert"`
+	TLSKeyFile       string        `goconf:"base:tls.key"`
+	RPCBind          []string      `goconf:"base:rpc.bind:,"`
+	PprofBind        []string      `goconf:"base:pprof.bind:,"`
+	StatBind         []string      `goconf:"base:stat.bind:,"`
+	DrainTimeout     time.Duration `goconf:"base:drain.timeout:time"`
 	// zookeeper
 	ZookeeperAddr        []string      `goconf:"zookeeper:addr:,"`
 	ZookeeperTimeout     time.Duration `goconf:"zookeeper:timeout:time"`
@@ -51,6 +86,7 @@ type Config struct {
 	ZookeeperCometNode   string        `goconf:"zookeeper:comet.node"`
 	ZookeeperCometWeight int           `goconf:"zookeeper:comet.weight"`
 	ZookeeperMessagePath string        `goconf:"zookeeper:message.path"`
+	ZookeeperIdPath      string        `goconf:"zookeeper:id.path"`
 	// rpc
 	RPCPing  time.Duration `goconf:"rpc:ping:time"`
 	RPCRetry time.Duration `goconf:"rpc:retry:time"`
@@ -63,25 +99,72 @@ type Config struct {
 	TCPKeepalive            bool          `goconf:"channel:tcp.keepalive"`
 	MaxSubscriberPerChannel int           `goconf:"channel:maxsubscriber"`
 	ChannelBucket           int           `goconf:"channel:bucket"`
+	ChannelIdleExpire       time.Duration `goconf:"channel:idle.expire:time"`
 	Auth                    bool          `goconf:"channel:auth"`
-	TokenExpire             time.Duration `goconf:"-"`
+	TokenExpire             time.Duration `goconf:"channel:token.expire:time"`
+	AuthMode                string        `goconf:"channel:auth.mode"`
+	AuthSecrets             []string      `goconf:"channel:auth.secrets:,"`
+	AuthExternalProto       string        `goconf:"channel:auth.external.proto"`
+	AuthExternalAddr        []string      `goconf:"channel:auth.external.addr:,"`
+	AuthExternalTimeout     time.Duration `goconf:"channel:auth.external.timeout:time"`
+	AuthCacheExpire         time.Duration `goconf:"channel:auth.cache.expire:time"`
+	AuthNegCacheExpire      time.Duration `goconf:"channel:auth.cache.negative.expire:time"`
+	AuthCacheSize           int           `goconf:"channel:auth.cache.size"`
 	MsgBufNum               int           `goconf:"channel:msgbuf.num"`
+	MaxTopicPerConn         int           `goconf:"channel:maxtopic"`
+	AckTimeout              time.Duration `goconf:"channel:ack.timeout:time"`
+	AckRetry                int           `goconf:"channel:ack.retry"`
+	MigrateBatch            int           `goconf:"channel:migrate.batch"`
+	MigrateInterval         time.Duration `goconf:"channel:migrate.interval:time"`
+	SlowPolicy              string        `goconf:"channel:slow.policy"`
+	Compress                bool          `goconf:"channel:compress"`
+	// upstream
+	UpstreamAddr    []string      `goconf:"upstream:addr:,"`
+	UpstreamTimeout time.Duration `goconf:"upstream:timeout:time"`
+	// presence
+	PresenceSink    string        `goconf:"presence:sink"`
+	PresenceAddr    []string      `goconf:"presence:addr:,"`
+	PresenceQueue   int           `goconf:"presence:queue"`
+	PresenceBatch   int           `goconf:"presence:batch"`
+	PresenceFlush   time.Duration `goconf:"presence:flush:time"`
+	PresenceTimeout time.Duration `goconf:"presence:timeout:time"`
 }
 
-// InitConfig get a new Config struct.
+// InitConfig init the global Config struct.
 func InitConfig() error {
-	Conf = &Config{
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	liveConf, err = reload.New(c, hotConf)
+	return err
+}
+
+// Conf get the current config, the config must not be modified.
+func Conf() *Config {
+	return liveConf.Get().(*Config)
+}
+
+// newConfig get a new Config struct from the config file.
+func newConfig() (*Config, error) {
+	conf := &Config{
 		// base
-		User:          "nobody nobody",
-		PidFile:       "/tmp/gopush-cluster-comet.pid",
-		Dir:           "./",
-		Log:           "./log/xml",
-		MaxProc:       runtime.NumCPU(),
-		WebsocketBind: []string{"localhost:6968"},
-		TCPBind:       []string{"localhost:6969"},
-		RPCBind:       []string{"localhost:6970"},
-		PprofBind:     []string{"localhost:6971"},
-		StatBind:      []string{"localhost:6972"},
+		User:             "nobody nobody",
+		PidFile:          "/tmp/gopush-cluster-comet.pid",
+		Dir:              "./",
+		Log:              "./log/xml",
+		MaxProc:          runtime.NumCPU(),
+		WebsocketBind:    []string{"localhost:6968"},
+		TCPBind:          []string{"localhost:6969"},
+		TCPTLSBind:       []string{},
+		TCPV2Bind:        []string{},
+		SSEBind:          []string{"localhost:6976"},
+		LongPollBind:     []string{"localhost:6977"},
+		WebsocketTLSBind: []string{},
+		RPCBind:          []string{"localhost:6970"},
+		PprofBind:        []string{"localhost:6971"},
+		StatBind:         []string{"localhost:6972"},
+		DrainTimeout:     30 * time.Second,
 		// zookeeper
 		ZookeeperAddr:        []string{"localhost:2181"},
 		ZookeeperTimeout:     30 * time.Second,
@@ -89,6 +172,7 @@ func InitConfig() error {
 		ZookeeperCometNode:   "node1",
 		ZookeeperCometWeight: 1,
 		ZookeeperMessagePath: "/gopush-cluster-message",
+		ZookeeperIdPath:      "/gopush-cluster-id",
 		// rpc
 		RPCPing:  1 * time.Second,
 		RPCRetry: 1 * time.Second,
@@ -102,15 +186,81 @@ func InitConfig() error {
 		TokenExpire:             30 * 24 * time.Hour,
 		MaxSubscriberPerChannel: 64,
 		ChannelBucket:           runtime.NumCPU(),
+		ChannelIdleExpire:       30 * time.Minute,
 		Auth:                    false,
+		AuthMode:                AuthModeToken,
+		AuthSecrets:             []string{},
+		AuthExternalProto:       AuthExternalHTTP,
+		AuthExternalAddr:        []string{},
+		AuthExternalTimeout:     3 * time.Second,
+		AuthCacheExpire:         1 * time.Minute,
+		AuthNegCacheExpire:      10 * time.Second,
+		AuthCacheSize:           10240,
 		MsgBufNum:               30,
+		MaxTopicPerConn:         32,
+		AckTimeout:              0,
+		AckRetry:                3,
+		MigrateBatch:            100,
+		MigrateInterval:         100 * time.Millisecond,
+		SlowPolicy:              SlowPolicyDisconnect,
+		Compress:                true,
+		// upstream
+		UpstreamAddr:    []string{},
+		UpstreamTimeout: 3 * time.Second,
+		// presence
+		PresenceSink:    "",
+		PresenceAddr:    []string{},
+		PresenceQueue:   10240,
+		PresenceBatch:   100,
+		PresenceFlush:   1 * time.Second,
+		PresenceTimeout: 3 * time.Second,
 	}
 	c := goconf.New()
 	if err := c.Parse(confFile); err != nil {
-		return err
+		return nil, err
 	}
-	if err := c.Unmarshal(Conf); err != nil {
-		return err
+	if err := c.Unmarshal(conf); err != nil {
+		return nil, err
+	}
+	if !validSlowPolicy(conf.SlowPolicy) {
+		return nil, ErrSlowPolicy
+	}
+	if !validAuthMode(conf.AuthMode) {
+		return nil, ErrAuthMode
+	}
+	if conf.AuthExternalProto != AuthExternalHTTP && conf.AuthExternalProto != AuthExternalRPC {
+		return nil, ErrAuthExternal
 	}
-	return nil
+	if !validPresence(conf) {
+		return nil, ErrPresenceSink
+	}
+	return conf, nil
+}
+
+// ReloadConfig re-read the config file and apply the hot settings, the
+// changed settings which can't be applied at runtime are reported in the
+// result.
+func ReloadConfig() *reload.Stat {
+	var cert *tls.Certificate
+	return liveConf.Reload(func() (interface{}, error) {
+		return newConfig()
+	}, func(c interface{}) (err error) {
+		// always re-read the certificate, the files may be replaced in place
+		cert, err = readTLS(c.(*Config))
+		return
+	}, func(c interface{}, applied []string) error {
+		tlsCert.Set(cert)
+		for _, name := range applied {
+			switch name {
+			case "Log":
+				log.LoadConfiguration(c.(*Config).Log)
+			case "ZookeeperCometWeight":
+				// the web nodes will migrate by the new weight
+				if err := UpdateZK(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 }
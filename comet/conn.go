@@ -19,15 +19,51 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	"fmt"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"golang.org/x/net/websocket"
 	"net"
+	"sync"
 )
 
 // Connection
 type Connection struct {
-	Conn    net.Conn
-	Proto   uint8
-	Version string
-	Buf     chan []byte
+	Conn     net.Conn
+	Proto    uint8
+	Version  string
+	TLS      bool
+	Encoding uint8 // negotiated message encoding
+	Replay   bool  // replay the stored private messages after LastMid when subscribed
+	LastMid  int64 // the last private message id got by the client
+	Buf      chan []byte
+	Topics   map[string]bool // joined topics, guarded by UserTopic
+	// unacked private messages and the attributes got by the external auth
+	ackMutex *sync.Mutex
+	unacked  map[int64]*unackedMsg
+	attrs    map[string]string
+	authSeq  uint32 // the binary auth frame seq, echoed by the first heartbeat
+	closed   bool
+	spilled  int32 // the private messages are left in the offline storage
+	// replay state, guarded by the channel lock
+	replaying    bool
+	held         []*heldMsg
+	heldOverflow bool
+}
+
+// Attrs get the attributes of the connection, eg: user id, device type. The
+// map is replaced as a whole when the token refreshed, it must not be
+// modified.
+func (c *Connection) Attrs() map[string]string {
+	c.ackMutex.Lock()
+	defer c.ackMutex.Unlock()
+	return c.attrs
+}
+
+// SetAttrs replace the attributes of the connection, called when the token
+// refreshed.
+func (c *Connection) SetAttrs(attrs map[string]string) {
+	c.ackMutex.Lock()
+	c.attrs = attrs
+	c.ackMutex.Unlock()
 }
 
 // HandleWrite start a goroutine get msg from chan, then send to the conn.
@@ -35,9 +71,15 @@ func (c *Connection) HandleWrite(key string) {
 	go func() {
 		var (
 			n   int
+			seq uint32
 			err error
 		)
 		log.Debug("user_key: \"%s\" HandleWrite goroutine start", key)
+		// the long-poll messages are taken by the polls
+		if c.Proto == LongPollProto {
+			log.Debug("user_key: \"%s\" HandleWrite goroutine stop, long-poll connection", key)
+			return
+		}
 		for {
 			msg, ok := <-c.Buf
 			if !ok {
@@ -45,12 +87,37 @@ func (c *Connection) HandleWrite(key string) {
 				return
 			}
 			if c.Proto == WebsocketProto {
-				// raw
-				n, err = c.Conn.Write(msg)
+				if c.Encoding == EncodingDeflate {
+					// compressed message use the binary frame
+					if err = websocket.Message.Send(c.Conn.(*websocket.Conn), msg); err == nil {
+						n = len(msg)
+					}
+				} else if c.Encoding == EncodingWSDeflate {
+					// permessage-deflate, the RSV1 bit set
+					n, err = c.Conn.(*wsDeflateConn).WriteDeflate(msg)
+				} else {
+					// raw
+					n, err = c.Conn.Write(msg)
+				}
 			} else if c.Proto == TCPProto {
-				// redis protocol
-				msg = []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(msg), string(msg)))
+				// redis protocol, compressed message use "%" instead of "$"
+				prefix := "$"
+				if c.Encoding == EncodingDeflate {
+					prefix = "%"
+				}
+				msg = []byte(fmt.Sprintf("%s%d\r\n%s\r\n", prefix, len(msg), string(msg)))
 				n, err = c.Conn.Write(msg)
+			} else if c.Proto == BinaryProto {
+				// binary frame
+				flags := uint16(0)
+				if c.Encoding == EncodingDeflate {
+					flags |= FlagDeflate
+				}
+				seq++
+				n, err = c.Conn.Write(encodeFrame(OpMessage, flags, seq, msg))
+			} else if c.Proto == SSEProto {
+				// sse message event
+				n, err = c.Conn.Write(sseEvent("", msg))
 			} else {
 				log.Error("unknown connection protocol: %d", c.Proto)
 				panic(ErrConnProto)
@@ -67,12 +134,74 @@ func (c *Connection) HandleWrite(key string) {
 	}()
 }
 
-// Write different message to client by different protocol
-func (c *Connection) Write(key string, msg []byte) {
+// heartbeatReply get the heartbeat reply by the connection protocol.
+func (c *Connection) heartbeatReply() []byte {
+	if c.Proto == BinaryProto {
+		return encodeFrame(OpHeartbeat, 0, c.authSeq, nil)
+	}
+	return c.reply(HeartbeatReply)
+}
+
+// redirectReply get the redirect reply by the connection protocol, if addr
+// is empty client should get a new addr by /server/get.
+func (c *Connection) redirectReply(addr string) []byte {
+	if c.Proto == BinaryProto {
+		return errorFrame(0, ErrCodeRedirect, addr)
+	}
+	return c.reply(redirectReply(addr))
+}
+
+// kickReply get the kick reply by the connection protocol.
+func (c *Connection) kickReply(reason string) []byte {
+	if c.Proto == BinaryProto {
+		return errorFrame(0, ErrCodeKick, reason)
+	}
+	return c.reply(kickReply(reason))
+}
+
+// reply convert the text reply by the connection protocol.
+func (c *Connection) reply(reply []byte) []byte {
+	if c.Proto == SSEProto {
+		return sseEvent(sseReplyEvent, trimReply(reply))
+	}
+	return reply
+}
+
+// Write different message to client by different protocol, if the
+// connection buf is full, handle the message by Conf().SlowPolicy.
+func (c *Connection) Write(key string, m *myrpc.Message, msg []byte) {
+	if m.GroupId == myrpc.PrivateGroupId && m.Stored && c.Spilled() {
+		MsgStat.IncrDeferred(1)
+		return
+	}
 	select {
 	case c.Buf <- msg:
+		return
+	default:
+	}
+	switch Conf().SlowPolicy {
+	case SlowPolicyDropOldest:
+		// drop the oldest buffered message, then retry
+		select {
+		case old := <-c.Buf:
+			MsgStat.IncrDroppedOldest(1)
+			log.Warn("user_key: \"%s\" slow consumer, drop oldest message: \"%s\"", key, string(old))
+		default:
+		}
+		select {
+		case c.Buf <- msg:
+		default:
+			MsgStat.IncrDroppedNewest(1)
+			log.Warn("user_key: \"%s\" slow consumer, drop newest message: \"%s\"", key, string(msg))
+		}
+	case SlowPolicyDropNewest:
+		MsgStat.IncrDroppedNewest(1)
+		log.Warn("user_key: \"%s\" slow consumer, drop newest message: \"%s\"", key, string(msg))
+	case SlowPolicySpill:
+		c.spill(key, m)
 	default:
 		c.Conn.Close()
+		MsgStat.IncrDisconnected(1)
 		log.Warn("user_key: \"%s\" discard message: \"%s\" and close connection", key, string(msg))
 	}
 }
@@ -0,0 +1,96 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+var (
+	// drain request by admin rpc
+	drainCH = make(chan bool, 1)
+	// 1 means draining
+	draining  int32
+	listeners = []net.Listener{}
+	lisMutex  = &sync.Mutex{}
+)
+
+// addListener add the listener, it will be closed when draining.
+func addListener(l net.Listener) {
+	lisMutex.Lock()
+	listeners = append(listeners, l)
+	lisMutex.Unlock()
+}
+
+// Draining check the comet is draining or not.
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// RequestDrain ask the main goroutine to drain, non-blocking.
+func RequestDrain() {
+	select {
+	case drainCH <- true:
+	default:
+	}
+}
+
+// Drain unregister the comet from zookeeper, stop accepting new connections,
+// flush the pending messages till Conf().DrainTimeout, then tell the clients to
+// reconnect to other nodes. The zk session (and the claimed id node) is kept
+// till the process exits, the comet still generates message ids meanwhile.
+func Drain() {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	log.Info("comet drain start")
+	deadline := time.Now().Add(Conf().DrainTimeout)
+	// stop accept
+	lisMutex.Lock()
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Error("listener.Close() error(%v)", err)
+		}
+	}
+	lisMutex.Unlock()
+	// delete the comet node, so the web nodes will migrate the channels to
+	// other comets.
+	unregisterZK()
+	// flush the pending messages
+	for !UserChannel.Flushed() {
+		if time.Now().After(deadline) {
+			log.Warn("comet drain timeout, discard the pending messages")
+			break
+		}
+		time.Sleep(drainCheckInterval)
+	}
+	// tell the clients to reconnect, the address is got by /server/get
+	for key, ch := range UserChannel.All() {
+		if err := ch.Redirect(key, nil); err != nil {
+			log.Error("ch.Redirect(\"%s\") error(%v)", key, err)
+		}
+	}
+	log.Info("comet drain finished")
+}
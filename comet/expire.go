@@ -0,0 +1,121 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"errors"
+	"github.com/Terry-Mao/gopush-cluster/heap"
+	"time"
+)
+
+const (
+	expireCheckInterval = 1 * time.Second
+	expireHeapSize      = 1024
+)
+
+var (
+	ErrChannelExpired = errors.New("Channel expired")
+)
+
+// idle channel in the expiration schedule of the bucket
+type idleChannel struct {
+	Key string
+	Ch  Channel
+}
+
+// InitExpire start the goroutine which evicts the idle channels, the channels
+// without connection and valid token are evicted after idle.expire.
+func InitExpire() {
+	if Conf().ChannelIdleExpire <= 0 {
+		log.Warn("channel idle.expire is 0, the idle channels never expire")
+		return
+	}
+	go expireProc()
+}
+
+// expireProc check the expiration schedule of every bucket.
+func expireProc() {
+	for {
+		time.Sleep(expireCheckInterval)
+		now := time.Now()
+		for _, b := range UserChannel.Channels {
+			if n := b.expireIdle(now); n > 0 {
+				ChStat.IncrEvict(uint64(n))
+			}
+		}
+	}
+}
+
+// schedule add the channel to the expiration schedule, the bucket must be
+// locked.
+func (b *ChannelBucket) schedule(key string, c Channel, deadline time.Time) {
+	if Conf().ChannelIdleExpire <= 0 {
+		return
+	}
+	b.expire.Add(&heap.Element{Key: int(deadline.Unix()), Value: &idleChannel{Key: key, Ch: c}})
+}
+
+// expireIdle evict the scheduled channels which are idle till now, the others
+// are rescheduled, return the evicted count. The due channels are popped
+// under the bucket lock but checked outside it, so the bucket lock is never
+// held while taking a channel lock.
+func (b *ChannelBucket) expireIdle(now time.Time) int {
+	var due []*idleChannel
+	b.Lock()
+	for {
+		e := b.expire.Min()
+		if e == nil || int64(e.Key) > now.Unix() {
+			break
+		}
+		b.expire.Poll()
+		ic, _ := e.Value.(*idleChannel)
+		// deleted or replaced, no need schedule
+		if c, ok := b.Data[ic.Key]; ok && c == ic.Ch {
+			due = append(due, ic)
+		}
+	}
+	b.Unlock()
+	if len(due) == 0 {
+		return 0
+	}
+	type checked struct {
+		deadline time.Time
+		expired  bool
+	}
+	res := make([]checked, len(due))
+	for i, ic := range due {
+		res[i].deadline, res[i].expired = ic.Ch.ExpireIdle(Conf().ChannelIdleExpire)
+	}
+	n := 0
+	b.Lock()
+	for i, ic := range due {
+		// deleted or replaced while checking
+		if c, ok := b.Data[ic.Key]; !ok || c != ic.Ch {
+			continue
+		}
+		if res[i].expired {
+			delete(b.Data, ic.Key)
+			n++
+			log.Info("user_key:\"%s\" evict idle channel", ic.Key)
+			continue
+		}
+		b.schedule(ic.Key, ic.Ch, res[i].deadline)
+	}
+	b.Unlock()
+	return n
+}
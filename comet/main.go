@@ -34,18 +34,36 @@ func main() {
 		panic(err)
 	}
 	// set max routine
-	runtime.GOMAXPROCS(Conf.MaxProc)
+	runtime.GOMAXPROCS(Conf().MaxProc)
 	// init log
-	log.LoadConfiguration(Conf.Log)
+	log.LoadConfiguration(Conf().Log)
 	defer log.Close()
 	// start pprof
-	perf.Init(Conf.PprofBind)
+	perf.Init(Conf().PprofBind)
 	// create channel
 	// if process exit, close channel
 	UserChannel = NewChannelList()
 	defer UserChannel.Close()
+	// start idle channel expiration goroutine
+	InitExpire()
+	// create topic list
+	UserTopic = NewTopicList()
 	// start stats
 	StartStats()
+	// load tls certificate
+	if err := LoadTLS(); err != nil {
+		panic(err)
+	}
+	// init external auth verifier
+	if err := InitAuth(); err != nil {
+		panic(err)
+	}
+	// init presence sink
+	if err := InitPresence(); err != nil {
+		panic(err)
+	}
+	// init upstream sink
+	InitUpstream()
 	// start rpc
 	if err := StartRPC(); err != nil {
 		panic(err)
@@ -62,13 +80,16 @@ func main() {
 		}
 		panic(err)
 	}
+	// the id node is released when the zk session closed
+	defer zkConn.Close()
 	// process init
-	if err = process.Init(Conf.User, Conf.Dir, Conf.PidFile); err != nil {
+	if err = process.Init(Conf().User, Conf().Dir, Conf().PidFile); err != nil {
 		panic(err)
 	}
 	// init signals, block wait signals
 	signalCH := InitSignal()
 	HandleSignal(signalCH)
-	// exit
+	// drain then exit
+	Drain()
 	log.Info("comet stop")
 }
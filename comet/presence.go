@@ -0,0 +1,170 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// presence sinks
+	PresenceSinkHTTP = "http"
+	PresenceSinkRPC  = "rpc"
+)
+
+var (
+	ErrPresenceSink    = errors.New("presence sink config error")
+	ErrPresenceRPC     = errors.New("Presence RPC not init")
+	presenceCH         chan *myrpc.PresenceEvent
+	presenceHTTPClient *http.Client
+)
+
+// validPresence check the presence sink settings.
+func validPresence(conf *Config) bool {
+	switch conf.PresenceSink {
+	case "":
+		return true
+	case PresenceSinkHTTP, PresenceSinkRPC:
+		return conf.PresenceQueue > 0 && conf.PresenceBatch > 0 && conf.PresenceFlush > 0
+	}
+	return false
+}
+
+// InitPresence start the goroutine which delivers the presence events, no
+// event is emitted if the sink is not configured.
+func InitPresence() error {
+	switch Conf().PresenceSink {
+	case "":
+		return nil
+	case PresenceSinkHTTP:
+		presenceHTTPClient = &http.Client{Timeout: Conf().PresenceTimeout}
+	case PresenceSinkRPC:
+		myrpc.InitPresence(Conf().PresenceAddr, Conf().RPCRetry, Conf().RPCPing)
+	}
+	presenceCH = make(chan *myrpc.PresenceEvent, Conf().PresenceQueue)
+	go presenceProc()
+	return nil
+}
+
+// presence emit a presence event of the connection, never blocks, the event
+// is dropped if the queue is full.
+func presence(typ, key string, conn *Connection, edge bool) {
+	if presenceCH == nil {
+		return
+	}
+	e := &myrpc.PresenceEvent{
+		Type:  typ,
+		Key:   key,
+		Node:  Conf().ZookeeperCometNode,
+		Proto: protoNames[conn.Proto],
+		Addr:  conn.Conn.RemoteAddr().String(),
+		Time:  time.Now().UnixNano(),
+		Attrs: conn.Attrs(),
+	}
+	if typ == myrpc.PresenceOnline {
+		e.First = edge
+	} else {
+		e.Last = edge
+	}
+	select {
+	case presenceCH <- e:
+	default:
+		ConnStat.IncrPresenceDropped(1)
+		log.Warn("user_key:\"%s\" presence queue full, drop %s event", key, typ)
+	}
+}
+
+// presenceProc batch the events, send them when the batch is full or every
+// flush interval.
+func presenceProc() {
+	var (
+		events = make([]*myrpc.PresenceEvent, 0, Conf().PresenceBatch)
+		ticker = time.NewTicker(Conf().PresenceFlush)
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-presenceCH:
+			if events = append(events, e); len(events) < Conf().PresenceBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(events) == 0 {
+				continue
+			}
+		}
+		if err := sendPresence(events); err != nil {
+			ConnStat.IncrPresenceDropped(uint64(len(events)))
+		} else {
+			ConnStat.IncrPresenceSent(uint64(len(events)))
+		}
+		events = make([]*myrpc.PresenceEvent, 0, Conf().PresenceBatch)
+	}
+}
+
+// sendPresence send a batch of events to the sink.
+func sendPresence(events []*myrpc.PresenceEvent) error {
+	if Conf().PresenceSink == PresenceSinkRPC {
+		client := myrpc.PresenceRPC.Get()
+		if client == nil {
+			log.Error("drop %d presence events error(%v)", len(events), ErrPresenceRPC)
+			return ErrPresenceRPC
+		}
+		ret := 0
+		if err := client.Call(myrpc.PresenceServiceReceive, &myrpc.PresenceArgs{Events: events}, &ret); err != nil {
+			log.Error("client.Call(\"%s\", %d events, &ret) error(%v)", myrpc.PresenceServiceReceive, len(events), err)
+			return err
+		}
+		return nil
+	}
+	return postPresence(events)
+}
+
+// postPresence post the events as a json array to a random webhook url, the
+// webhook must reply 2xx.
+func postPresence(events []*myrpc.PresenceEvent) error {
+	if len(Conf().PresenceAddr) == 0 {
+		log.Error("drop %d presence events error(%v)", len(events), ErrPresenceSink)
+		return ErrPresenceSink
+	}
+	url := Conf().PresenceAddr[rand.Intn(len(Conf().PresenceAddr))]
+	body, err := json.Marshal(events)
+	if err != nil {
+		log.Error("json.Marshal() error(%v)", err)
+		return err
+	}
+	resp, err := presenceHTTPClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("http.Post(\"%s\") error(%v)", url, err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("http status code %d", resp.StatusCode)
+		log.Error("http.Post(\"%s\") error(%v)", url, err)
+		return err
+	}
+	return nil
+}
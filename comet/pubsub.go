@@ -18,16 +18,32 @@ package main
 
 import (
 	log "github.com/alecthomas/log4go"
+	"encoding/json"
 	"errors"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"strconv"
 	"time"
 )
 
 const (
 	TCPProto               = uint8(0)
 	WebsocketProto         = uint8(1)
+	BinaryProto            = uint8(2)
+	SSEProto               = uint8(3)
+	LongPollProto          = uint8(4)
 	WebsocketProtoStr      = "websocket"
 	TCPProtoStr            = "tcp"
+	SSEProtoStr            = "sse"
+	LongPollProtoStr       = "longpoll"
+	BinaryProtoStr         = "tcp2"
+	binaryVersion          = "2.0"
 	Heartbeat              = "h"
+	JoinCmd                = "join"
+	LeaveCmd               = "leave"
+	PubCmd                 = "pub"
+	AckCmd                 = "ack"
+	UnsubCmd               = "unsub"
+	TokenCmd               = "token"
 	minHearbeatSec         = 30
 	delayHeartbeatSec      = 5
 	fitstPacketTimedoutSec = time.Second * 5
@@ -51,11 +67,43 @@ var (
 	ParamReply = []byte("-p\r\n")
 	// node error reply
 	NodeReply = []byte("-n\r\n")
+	// command ok reply
+	OKReply = []byte("+o\r\n")
+	// topic error reply
+	TopicReply = []byte("-t\r\n")
+	// upstream error reply
+	UpstreamReply = []byte("-u\r\n")
+	// protocol names of the connections
+	protoNames = map[uint8]string{
+		TCPProto:       TCPProtoStr,
+		WebsocketProto: WebsocketProtoStr,
+		BinaryProto:    BinaryProtoStr,
+		SSEProto:       SSEProtoStr,
+		LongPollProto:  LongPollProtoStr,
+	}
 )
 
+// redirectReply get the redirect reply, tell client reconnect to the addr,
+// if addr is empty client should get a new addr by /server/get.
+func redirectReply(addr string) []byte {
+	if addr == "" {
+		return []byte("-r\r\n")
+	}
+	return []byte("-r " + addr + "\r\n")
+}
+
+// kickReply get the kick reply, tell client the connection is closed by the
+// operator with the reason.
+func kickReply(reason string) []byte {
+	if reason == "" {
+		return []byte("-k\r\n")
+	}
+	return []byte("-k " + reason + "\r\n")
+}
+
 // StartListen start accept client.
 func StartComet() error {
-	for _, proto := range Conf.Proto {
+	for _, proto := range Conf().Proto {
 		if proto == WebsocketProtoStr {
 			// Start http push service
 			if err := StartWebsocket(); err != nil {
@@ -66,9 +114,109 @@ func StartComet() error {
 			if err := StartTCP(); err != nil {
 				return err
 			}
+		} else if proto == SSEProtoStr {
+			// Start sse push service
+			if err := StartSSE(); err != nil {
+				return err
+			}
+		} else if proto == LongPollProtoStr {
+			// Start long-poll push service
+			if err := StartLongPoll(); err != nil {
+				return err
+			}
 		} else {
-			log.Warn("unknown gopush-cluster protocol %s, (\"websocket\" or \"tcp\")", proto)
+			log.Warn("unknown gopush-cluster protocol %s, (\"websocket\", \"tcp\", \"sse\" or \"longpoll\")", proto)
+		}
+	}
+	return nil
+}
+
+// handleCmd handle the command sent by a subscribed connection, return the
+// reply and whether the connection should be closed.
+func handleCmd(key string, c Channel, conn *Connection, args []string) ([]byte, bool) {
+	if len(args) == 0 {
+		return ParamReply, false
+	}
+	switch args[0] {
+	case JoinCmd:
+		if len(args) != 2 {
+			return ParamReply, false
+		}
+		if err := UserTopic.Join(key, args[1], conn); err != nil {
+			return TopicReply, false
 		}
+	case LeaveCmd:
+		if len(args) != 2 {
+			return ParamReply, false
+		}
+		if err := UserTopic.Leave(key, args[1], conn); err != nil {
+			log.Warn("user_key:\"%s\" leave topic:\"%s\" error(%v)", key, args[1], err)
+			return TopicReply, false
+		}
+	case PubCmd:
+		if len(args) != 2 || !json.Valid([]byte(args[1])) {
+			log.Warn("user_key:\"%s\" pub cmd message not json", key)
+			return ParamReply, false
+		}
+		if err := upstream(&myrpc.UpstreamArgs{Key: key, Cmd: PubCmd, Msg: json.RawMessage(args[1])}); err != nil {
+			return UpstreamReply, false
+		}
+	case AckCmd:
+		if len(args) != 2 {
+			return ParamReply, false
+		}
+		mid, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			log.Warn("user_key:\"%s\" ack mid:\"%s\" error(%v)", key, args[1], err)
+			return ParamReply, false
+		}
+		if err = ackMsg(key, conn, mid); err != nil {
+			return UpstreamReply, false
+		}
+	case UnsubCmd:
+		if err := upstream(&myrpc.UpstreamArgs{Key: key, Cmd: UnsubCmd}); err != nil {
+			// ignore upstream error, the connection closed anyway
+			log.Warn("user_key:\"%s\" unsub upstream error(%v)", key, err)
+		}
+		return OKReply, true
+	case TokenCmd:
+		if len(args) != 2 {
+			return ParamReply, false
+		}
+		// the new token must be registered by CometRPC.New first
+		attrs, ok := c.AuthToken(key, args[1])
+		if !ok {
+			log.Error("user_key:\"%s\" refresh token \"%s\" failed", key, args[1])
+			return AuthReply, false
+		}
+		if attrs != nil {
+			conn.SetAttrs(attrs)
+		}
+		if err := upstream(&myrpc.UpstreamArgs{Key: key, Cmd: TokenCmd, Token: args[1]}); err != nil {
+			return UpstreamReply, false
+		}
+	default:
+		log.Warn("user_key:\"%s\" unknown cmd \"%s\"", key, args[0])
+		return ParamReply, false
+	}
+	return OKReply, false
+}
+
+// ackMsg handle the private message ack sent by a subscribed connection, only
+// return the upstream error.
+func ackMsg(key string, conn *Connection, mid int64) error {
+	if ok := conn.Ack(key, mid); !ok {
+		log.Debug("user_key:\"%s\" ack mid:%d not tracked", key, mid)
+	} else if ch, err := UserChannel.Get(key, false); err == nil && !ch.Unacked(mid) {
+		// acked by all the connections of the key no need redelivery by
+		// offline message, the other devices still get it if not acked
+		if err := ackPrivate(key, mid); err != nil {
+			log.Error("ackPrivate(\"%s\", %d) error(%v)", key, mid, err)
+		}
+	}
+	// forward to the upstream sink only if configured
+	if len(Conf().UpstreamAddr) > 0 {
+		return upstream(&myrpc.UpstreamArgs{Key: key, Cmd: AckCmd, MsgId: mid})
 	}
 	return nil
 }
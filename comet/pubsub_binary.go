@@ -0,0 +1,253 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	log "github.com/alecthomas/log4go"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// The binary protocol (v2), every frame is a 12 bytes header followed by the
+// body, all the integers are big-endian:
+//
+// +---------+--------+-----------+---------+------------------+
+// | len (4) | op (2) | flags (2) | seq (4) | body (len bytes) |
+// +---------+--------+-----------+---------+------------------+
+//
+// The flags of the message frame tell the body encoding, eg: FlagDeflate.
+// The replies of the client frames carry the same seq, the message frames
+// pushed by comet carry a per connection increasing seq.
+const (
+	binaryHeaderLen  = 12
+	binaryMaxBodyLen = 4096
+	// opcodes
+	OpHeartbeat = uint16(1)
+	OpAuth      = uint16(2)
+	OpMessage   = uint16(3)
+	OpAck       = uint16(4)
+	OpError     = uint16(5)
+	// error codes, the first byte of the error frame body
+	ErrCodeParam    = byte(1)
+	ErrCodeAuth     = byte(2)
+	ErrCodeChannel  = byte(3)
+	ErrCodeNode     = byte(4)
+	ErrCodeUpstream = byte(5)
+	ErrCodeRedirect = byte(6)
+	ErrCodeKick     = byte(7)
+)
+
+var (
+	ErrFrameLen = errors.New("binary frame body too large")
+)
+
+// binary frame.
+type binaryFrame struct {
+	Op    uint16
+	Flags uint16
+	Seq   uint32
+	Body  []byte
+}
+
+// binary auth frame body.
+type binaryAuthArgs struct {
+	Key       string `json:"key"`
+	Token     string `json:"token"`
+	Heartbeat int    `json:"heartbeat"`
+	Version   string `json:"ver"`
+	Caps      string `json:"caps"`
+}
+
+// encodeFrame encode a binary frame.
+func encodeFrame(op, flags uint16, seq uint32, body []byte) []byte {
+	buf := make([]byte, binaryHeaderLen+len(body))
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(body)))
+	binary.BigEndian.PutUint16(buf[4:], op)
+	binary.BigEndian.PutUint16(buf[6:], flags)
+	binary.BigEndian.PutUint32(buf[8:], seq)
+	copy(buf[binaryHeaderLen:], body)
+	return buf
+}
+
+// errorFrame encode a binary error frame, the body is the error code and the
+// optional detail.
+func errorFrame(seq uint32, code byte, detail string) []byte {
+	return encodeFrame(OpError, 0, seq, append([]byte{code}, detail...))
+}
+
+// readFrame read a binary frame.
+func readFrame(rd *bufio.Reader) (*binaryFrame, error) {
+	header := make([]byte, binaryHeaderLen)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return nil, err
+	}
+	bodyLen := binary.BigEndian.Uint32(header[0:])
+	if bodyLen > binaryMaxBodyLen {
+		return nil, ErrFrameLen
+	}
+	f := &binaryFrame{
+		Op:    binary.BigEndian.Uint16(header[4:]),
+		Flags: binary.BigEndian.Uint16(header[6:]),
+		Seq:   binary.BigEndian.Uint32(header[8:]),
+		Body:  make([]byte, bodyLen),
+	}
+	if _, err := io.ReadFull(rd, f.Body); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// handleBinaryConn handle a long live binary protocol connection.
+func handleBinaryConn(conn net.Conn, rc chan *bufio.Reader) {
+	addr := conn.RemoteAddr().String()
+	log.Debug("<%s> handleBinaryConn routine start", addr)
+	rd := newBufioReader(rc, conn)
+	// first frame must be auth
+	if f, err := readFrame(rd); err == nil {
+		// the frame loop reads by the connection own reader
+		crd := connBufioReader(rd, conn)
+		// return buffer bufio.Reader
+		putBufioReader(rc, rd)
+		if f.Op == OpAuth {
+			SubscribeBinaryHandle(conn, crd, f)
+		} else {
+			conn.Write(errorFrame(f.Seq, ErrCodeParam, ""))
+			log.Warn("<%s> unknown first opcode %d", addr, f.Op)
+		}
+	} else {
+		// return buffer bufio.Reader
+		putBufioReader(rc, rd)
+		log.Error("<%s> readFrame() error(%v)", addr, err)
+	}
+	// close the connection
+	if err := conn.Close(); err != nil {
+		log.Error("<%s> conn.Close() error(%v)", addr, err)
+	}
+	log.Debug("<%s> handleBinaryConn routine stop", addr)
+}
+
+// SubscribeBinaryHandle handle the binary protocol subscribers's connection.
+func SubscribeBinaryHandle(conn net.Conn, rd *bufio.Reader, auth *binaryFrame) {
+	addr := conn.RemoteAddr().String()
+	args := &binaryAuthArgs{}
+	if err := json.Unmarshal(auth.Body, args); err != nil {
+		conn.Write(errorFrame(auth.Seq, ErrCodeParam, ""))
+		log.Error("<%s> json.Unmarshal(\"%s\") error(%v)", addr, string(auth.Body), err)
+		return
+	}
+	key := args.Key
+	if key == "" {
+		conn.Write(errorFrame(auth.Seq, ErrCodeParam, ""))
+		log.Warn("<%s> key param error", addr)
+		return
+	}
+	if args.Heartbeat < minHearbeatSec {
+		conn.Write(errorFrame(auth.Seq, ErrCodeParam, ""))
+		log.Warn("<%s> user_key:\"%s\" heartbeat argument error, less than %d", addr, key, minHearbeatSec)
+		return
+	}
+	heartbeat := args.Heartbeat + delayHeartbeatSec
+	// binary clients always use the new message format
+	version := args.Version
+	if version == "" {
+		version = binaryVersion
+	}
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s, caps = %s", addr, key, heartbeat, args.Token, version, args.Caps)
+	// fetch subscriber from the channel and auth token
+	c, attrs, err := UserChannel.GetAuth(key, args.Token)
+	if err != nil {
+		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
+		if err == ErrChannelKey {
+			conn.Write(errorFrame(auth.Seq, ErrCodeNode, ""))
+		} else if err == ErrChannelAuth {
+			conn.Write(errorFrame(auth.Seq, ErrCodeAuth, ""))
+		} else {
+			conn.Write(errorFrame(auth.Seq, ErrCodeChannel, ""))
+		}
+		return
+	}
+	// add a conn to the channel, the first heartbeat frame with the auth seq
+	// tells client the auth succeed
+	_, secure := conn.(*tls.Conn)
+	connection := &Connection{Conn: conn, Proto: BinaryProto, Version: version, TLS: secure, Encoding: parseCaps(args.Caps), attrs: attrs, authSeq: auth.Seq}
+	c, connElem, err := UserChannel.AddConn(key, c, connection)
+	if err != nil {
+		conn.Write(errorFrame(auth.Seq, ErrCodeChannel, ""))
+		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
+		return
+	}
+	// blocking wait client heartbeat or ack
+	var (
+		f     *binaryFrame
+		reply []byte
+	)
+	begin := time.Now().UnixNano()
+	end := begin + Second
+	for {
+		// more then 1 sec, reset the timer
+		if end-begin >= Second {
+			if err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(heartbeat))); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, key, err)
+				break
+			}
+			begin = end
+		}
+		if f, err = readFrame(rd); err != nil {
+			if err != io.EOF {
+				log.Warn("<%s> user_key:\"%s\" readFrame() failed, read heartbeat timedout error(%v)", addr, key, err)
+			} else {
+				// client connection close
+				log.Warn("<%s> user_key:\"%s\" client connection close error(%v)", addr, key, err)
+			}
+			break
+		}
+		reply = nil
+		switch f.Op {
+		case OpHeartbeat:
+			reply = encodeFrame(OpHeartbeat, 0, f.Seq, nil)
+			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+		case OpAck:
+			if len(f.Body) != 8 {
+				reply = errorFrame(f.Seq, ErrCodeParam, "")
+				break
+			}
+			if err = ackMsg(key, connection, int64(binary.BigEndian.Uint64(f.Body))); err != nil {
+				reply = errorFrame(f.Seq, ErrCodeUpstream, "")
+			}
+		default:
+			log.Warn("<%s> user_key:\"%s\" unknown opcode %d", addr, key, f.Op)
+			reply = errorFrame(f.Seq, ErrCodeParam, "")
+		}
+		if reply != nil {
+			if _, err = conn.Write(reply); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.Write() failed, write reply to client error(%v)", addr, key, err)
+				break
+			}
+		}
+		end = time.Now().UnixNano()
+	}
+	// remove exists conn
+	if err := c.RemoveConn(key, connElem); err != nil {
+		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, key, err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestBinaryFrame(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encodeFrame(OpMessage, FlagDeflate, 7, []byte("hello")))
+	buf.Write(encodeFrame(OpHeartbeat, 0, 8, nil))
+	buf.Write(errorFrame(9, ErrCodeAuth, "detail"))
+	rd := bufio.NewReader(&buf)
+	f, err := readFrame(rd)
+	if err != nil {
+		t.Fatalf("readFrame() error(%v)", err)
+	}
+	if f.Op != OpMessage || f.Flags != FlagDeflate || f.Seq != 7 || string(f.Body) != "hello" {
+		t.Errorf("message frame %+v", f)
+	}
+	if f, err = readFrame(rd); err != nil {
+		t.Fatalf("readFrame() error(%v)", err)
+	}
+	if f.Op != OpHeartbeat || f.Flags != 0 || f.Seq != 8 || len(f.Body) != 0 {
+		t.Errorf("heartbeat frame %+v", f)
+	}
+	if f, err = readFrame(rd); err != nil {
+		t.Fatalf("readFrame() error(%v)", err)
+	}
+	if f.Op != OpError || f.Seq != 9 || f.Body[0] != ErrCodeAuth || string(f.Body[1:]) != "detail" {
+		t.Errorf("error frame %+v", f)
+	}
+	if _, err = readFrame(rd); err != io.EOF {
+		t.Errorf("readFrame() error(%v), expect EOF", err)
+	}
+	// truncated body
+	b := encodeFrame(OpAck, 0, 10, make([]byte, 8))
+	if _, err = readFrame(bufio.NewReader(bytes.NewReader(b[:len(b)-1]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("readFrame() error(%v), expect ErrUnexpectedEOF", err)
+	}
+}
+
+func TestBinaryFrameLen(t *testing.T) {
+	b := encodeFrame(OpAuth, 0, 1, make([]byte, binaryMaxBodyLen))
+	f, err := readFrame(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatalf("readFrame() error(%v)", err)
+	}
+	if len(f.Body) != binaryMaxBodyLen {
+		t.Errorf("body len %d", len(f.Body))
+	}
+	// the body is rejected by the header before being read
+	header := make([]byte, binaryHeaderLen)
+	binary.BigEndian.PutUint32(header, binaryMaxBodyLen+1)
+	binary.BigEndian.PutUint16(header[4:], OpAuth)
+	if _, err = readFrame(bufio.NewReader(bytes.NewReader(header))); err != ErrFrameLen {
+		t.Errorf("readFrame() error(%v), expect ErrFrameLen", err)
+	}
+}
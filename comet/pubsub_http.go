@@ -0,0 +1,533 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Terry-Mao/gopush-cluster/hlist"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// sse event of the replies, eg: heartbeat, redirect
+	sseReplyEvent = "reply"
+	// long-poll session id length in bytes
+	sessionIdLen = 16
+)
+
+var (
+	ErrLongPollClosed = errors.New("long-poll session closed")
+	// the response header of sse, the body is ended by closing the connection
+	sseHeader = []byte("HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nCache-Control: no-cache\r\nConnection: close\r\nAccess-Control-Allow-Origin: *\r\n\r\n")
+	// long-poll sessions
+	sessions     = map[string]*longPollSession{}
+	sessionMutex = &sync.Mutex{}
+)
+
+// StartSSE start sse listen.
+func StartSSE() error {
+	for _, bind := range Conf().SSEBind {
+		log.Info("start sse listen addr:\"%s\"", bind)
+		go httpSubListen(bind, SubscribeSSEHandle)
+	}
+	return nil
+}
+
+// StartLongPoll start long-poll listen.
+func StartLongPoll() error {
+	for _, bind := range Conf().LongPollBind {
+		log.Info("start long-poll listen addr:\"%s\"", bind)
+		go httpSubListen(bind, SubscribeLongPollHandle)
+	}
+	return nil
+}
+
+// httpSubListen serve the http transport "/sub" on the bind.
+func httpSubListen(bind string, handler http.HandlerFunc) {
+	httpServeMux := http.NewServeMux()
+	httpServeMux.HandleFunc("/sub", handler)
+	server := &http.Server{Handler: httpServeMux}
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+	addListener(l)
+	if Conf().TCPKeepalive {
+		l = &KeepAliveListener{Listener: l}
+	}
+	if err := server.Serve(l); err != nil {
+		if Draining() {
+			log.Info("http addr: \"%s\" stop accept", bind)
+			return
+		}
+		log.Error("server.Serve(\"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+}
+
+// the subscribe arguments of the http transports.
+type httpSubArgs struct {
+	Key       string
+	Heartbeat int
+	Token     string
+	Version   string
+}
+
+// parseHTTPSub parse the subscribe arguments, return the reply if failed.
+func parseHTTPSub(r *http.Request) (*httpSubArgs, []byte) {
+	addr := r.RemoteAddr
+	params := r.URL.Query()
+	key := params.Get("key")
+	if key == "" {
+		log.Warn("<%s> key param error", addr)
+		return nil, ParamReply
+	}
+	heartbeatStr := params.Get("heartbeat")
+	i, err := strconv.Atoi(heartbeatStr)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" heartbeat argument error(%v)", addr, key, err)
+		return nil, ParamReply
+	}
+	if i < minHearbeatSec {
+		log.Warn("<%s> user_key:\"%s\" heartbeat argument error, less than %d", addr, key, minHearbeatSec)
+		return nil, ParamReply
+	}
+	args := &httpSubArgs{Key: key, Heartbeat: i, Token: params.Get("token"), Version: params.Get("ver")}
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s", addr, key, i, args.Token, args.Version)
+	return args, nil
+}
+
+// getAuthChannel get the channel of the subscriber and auth the token,
+// return the connection attributes, or the reply if failed.
+func getAuthChannel(addr string, args *httpSubArgs) (Channel, map[string]string, []byte) {
+	c, attrs, err := UserChannel.GetAuth(args.Key, args.Token)
+	if err != nil {
+		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, args.Key, err)
+		if err == ErrChannelKey {
+			return nil, nil, NodeReply
+		} else if err == ErrChannelAuth {
+			return nil, nil, AuthReply
+		}
+		return nil, nil, ChannelReply
+	}
+	return c, attrs, nil
+}
+
+// sseEvent encode a sse event, empty event means the default "message".
+func sseEvent(event string, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// trimReply trim the CRLF of the reply.
+func trimReply(reply []byte) []byte {
+	return bytes.TrimRight(reply, "\r\n")
+}
+
+// SubscribeSSEHandle is the sse handle for sub request, the messages are sent
+// as the "message" events and the replies are sent as the "reply" events.
+func SubscribeSSEHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	addr := r.RemoteAddr
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		log.Error("<%s> http.ResponseWriter assert type http.Hijacker failed", addr)
+		http.Error(w, "Internal Server Error", 500)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Error("<%s> Hijack() error(%v)", addr, err)
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Error("<%s> conn.Close() error(%v)", addr, err)
+		}
+	}()
+	if _, err = conn.Write(sseHeader); err != nil {
+		log.Error("<%s> conn.Write() failed, write sse header error(%v)", addr, err)
+		return
+	}
+	args, reply := parseHTTPSub(r)
+	if reply != nil {
+		conn.Write(sseEvent(sseReplyEvent, trimReply(reply)))
+		return
+	}
+	c, attrs, reply := getAuthChannel(addr, args)
+	if reply != nil {
+		conn.Write(sseEvent(sseReplyEvent, trimReply(reply)))
+		return
+	}
+	// add a conn to the channel
+	connection := &Connection{Conn: conn, Proto: SSEProto, Version: args.Version, attrs: attrs}
+	c, connElem, err := UserChannel.AddConn(args.Key, c, connection)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, args.Key, err)
+		return
+	}
+	// sse is one-way, comet sends a heartbeat every period, the read only
+	// detects the client closing
+	buf := make([]byte, 1)
+	for {
+		if err = conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(args.Heartbeat))); err != nil {
+			log.Error("<%s> user_key:\"%s\" conn.SetReadDeadLine() error(%v)", addr, args.Key, err)
+			break
+		}
+		if _, err = rw.Read(buf); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				if _, err = conn.Write(connection.heartbeatReply()); err != nil {
+					log.Error("<%s> user_key:\"%s\" conn.Write() failed, write heartbeat to client error(%v)", addr, args.Key, err)
+					break
+				}
+				continue
+			}
+			if err != io.EOF {
+				log.Warn("<%s> user_key:\"%s\" conn.Read() error(%v)", addr, args.Key, err)
+			} else {
+				// client connection close
+				log.Warn("<%s> user_key:\"%s\" client connection close error(%v)", addr, args.Key, err)
+			}
+			break
+		}
+	}
+	// remove exists conn
+	if err := c.RemoveConn(args.Key, connElem); err != nil {
+		log.Error("<%s> user_key:\"%s\" remove conn error(%v)", addr, args.Key, err)
+	}
+}
+
+// long-poll response.
+type longPollResp struct {
+	Sid     string            `json:"sid,omitempty"`
+	Replies []string          `json:"replies"`
+	Msgs    []json.RawMessage `json:"msgs"`
+	Closed  bool              `json:"closed,omitempty"`
+}
+
+// longPollAddr implements net.Addr for the long-poll connection.
+type longPollAddr string
+
+func (a longPollAddr) Network() string {
+	return "tcp"
+}
+
+func (a longPollAddr) String() string {
+	return string(a)
+}
+
+// longPollConn implements net.Conn for the long-poll connection, the written
+// replies are returned by the next poll.
+type longPollConn struct {
+	mutex    *sync.Mutex
+	replies  []string
+	notifyCH chan bool
+	closeCH  chan bool
+	closed   bool
+	addr     longPollAddr
+}
+
+func newLongPollConn(addr string) *longPollConn {
+	return &longPollConn{
+		mutex:    &sync.Mutex{},
+		replies:  []string{},
+		notifyCH: make(chan bool, 1),
+		closeCH:  make(chan bool),
+		addr:     longPollAddr(addr),
+	}
+}
+
+// Read implements the net.Conn Read method, the long-poll connection never
+// read.
+func (c *longPollConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write implements the net.Conn Write method, save the reply and notify the
+// waiting poll.
+func (c *longPollConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return 0, ErrLongPollClosed
+	}
+	c.replies = append(c.replies, string(trimReply(b)))
+	select {
+	case c.notifyCH <- true:
+	default:
+	}
+	return len(b), nil
+}
+
+// Close implements the net.Conn Close method.
+func (c *longPollConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.closeCH)
+	}
+	return nil
+}
+
+// Replies get and clear the saved replies.
+func (c *longPollConn) Replies() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	replies := c.replies
+	c.replies = []string{}
+	return replies
+}
+
+// Pending check if any saved reply.
+func (c *longPollConn) Pending() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.replies) > 0
+}
+
+func (c *longPollConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *longPollConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *longPollConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *longPollConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *longPollConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// long-poll session, the connection lives across the polls, comet buffers
+// the messages in Connection.Buf till the next poll.
+type longPollSession struct {
+	id        string
+	key       string
+	heartbeat time.Duration
+	conn      *Connection
+	lp        *longPollConn
+	mutex     *sync.Mutex
+	polling   bool
+	last      time.Time
+}
+
+// newSessionId create a random session id.
+func newSessionId() (string, error) {
+	b := make([]byte, sessionIdLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// watch remove the connection if the session closed or not polled in a
+// heartbeat period.
+func (s *longPollSession) watch(c Channel, e *hlist.Element) {
+	for {
+		select {
+		case <-s.lp.closeCH:
+			s.remove(c, e)
+			return
+		case <-time.After(s.heartbeat):
+			s.mutex.Lock()
+			expired := !s.polling && time.Since(s.last) >= s.heartbeat
+			s.mutex.Unlock()
+			if expired {
+				log.Warn("user_key:\"%s\" long-poll session:\"%s\" expired", s.key, s.id)
+				s.remove(c, e)
+				return
+			}
+		}
+	}
+}
+
+// remove delete the session and remove the connection from the channel.
+func (s *longPollSession) remove(c Channel, e *hlist.Element) {
+	sessionMutex.Lock()
+	delete(sessions, s.id)
+	sessionMutex.Unlock()
+	s.lp.Close()
+	if err := c.RemoveConn(s.key, e); err != nil {
+		log.Error("user_key:\"%s\" remove conn error(%v)", s.key, err)
+	}
+}
+
+// poll wait the messages or replies till a heartbeat period, then return all
+// of them.
+func (s *longPollSession) poll() *longPollResp {
+	res := &longPollResp{Sid: s.id, Msgs: []json.RawMessage{}}
+	// drop the stale notification, the saved replies are checked after
+	select {
+	case <-s.lp.notifyCH:
+	default:
+	}
+	if !s.lp.Pending() {
+		select {
+		case msg, ok := <-s.conn.Buf:
+			if !ok {
+				res.Closed = true
+			} else {
+				res.Msgs = append(res.Msgs, json.RawMessage(msg))
+			}
+		case <-s.lp.notifyCH:
+		case <-s.lp.closeCH:
+			res.Closed = true
+		case <-time.After(s.heartbeat - delayHeartbeatSec*time.Second):
+			// no message, tell client the connection alive
+			res.Replies = append(res.Replies, string(trimReply(HeartbeatReply)))
+		}
+	}
+	// get all the buffered messages
+drain:
+	for !res.Closed {
+		select {
+		case msg, ok := <-s.conn.Buf:
+			if !ok {
+				res.Closed = true
+				break drain
+			}
+			res.Msgs = append(res.Msgs, json.RawMessage(msg))
+		default:
+			break drain
+		}
+	}
+	res.Replies = append(s.lp.Replies(), res.Replies...)
+	MsgStat.IncrSucceed(uint64(len(res.Msgs)))
+	return res
+}
+
+// SubscribeLongPollHandle is the long-poll handle for sub request, the first
+// request subscribes and gets a session id, the following requests poll the
+// messages by the session id.
+func SubscribeLongPollHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	var res *longPollResp
+	addr := r.RemoteAddr
+	sid := r.URL.Query().Get("sid")
+	if sid == "" {
+		res = newLongPollSession(r)
+	} else {
+		sessionMutex.Lock()
+		s, ok := sessions[sid]
+		sessionMutex.Unlock()
+		if !ok {
+			log.Warn("<%s> long-poll session:\"%s\" not exists", addr, sid)
+			res = &longPollResp{Replies: []string{string(trimReply(ChannelReply))}, Msgs: []json.RawMessage{}, Closed: true}
+		} else {
+			s.mutex.Lock()
+			if s.polling {
+				s.mutex.Unlock()
+				log.Warn("<%s> user_key:\"%s\" long-poll session:\"%s\" is polling", addr, s.key, sid)
+				res = &longPollResp{Sid: sid, Replies: []string{string(trimReply(ParamReply))}, Msgs: []json.RawMessage{}}
+			} else {
+				s.polling = true
+				s.mutex.Unlock()
+				res = s.poll()
+				s.mutex.Lock()
+				s.polling = false
+				s.last = time.Now()
+				s.mutex.Unlock()
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error("<%s> json.Encode() error(%v)", addr, err)
+	}
+}
+
+// newLongPollSession subscribe and create a long-poll session.
+func newLongPollSession(r *http.Request) *longPollResp {
+	addr := r.RemoteAddr
+	res := &longPollResp{Msgs: []json.RawMessage{}, Closed: true}
+	args, reply := parseHTTPSub(r)
+	if reply != nil {
+		res.Replies = []string{string(trimReply(reply))}
+		return res
+	}
+	c, attrs, reply := getAuthChannel(addr, args)
+	if reply != nil {
+		res.Replies = []string{string(trimReply(reply))}
+		return res
+	}
+	sid, err := newSessionId()
+	if err != nil {
+		log.Error("<%s> newSessionId() error(%v)", addr, err)
+		res.Replies = []string{string(trimReply(ChannelReply))}
+		return res
+	}
+	lp := newLongPollConn(addr)
+	s := &longPollSession{
+		id:        sid,
+		key:       args.Key,
+		heartbeat: time.Second * time.Duration(args.Heartbeat+delayHeartbeatSec),
+		conn:      &Connection{Conn: lp, Proto: LongPollProto, Version: args.Version, attrs: attrs},
+		lp:        lp,
+		mutex:     &sync.Mutex{},
+		last:      time.Now(),
+	}
+	// add a conn to the channel, the first heartbeat reply is saved in lp
+	c, connElem, err := UserChannel.AddConn(args.Key, c, s.conn)
+	if err != nil {
+		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, args.Key, err)
+		res.Replies = []string{string(trimReply(ChannelReply))}
+		return res
+	}
+	sessionMutex.Lock()
+	sessions[sid] = s
+	sessionMutex.Unlock()
+	go s.watch(c, connElem)
+	res.Sid = sid
+	res.Replies = lp.Replies()
+	res.Closed = false
+	return res
+}
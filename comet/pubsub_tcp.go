@@ -18,7 +18,9 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	log "github.com/alecthomas/log4go"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -28,7 +30,9 @@ import (
 
 const (
 	minCmdNum = 1
-	maxCmdNum = 5
+	maxCmdNum = 7
+	// the max length of a command argument, eg: the upstream "pub" message
+	maxCmdLen = 4096
 )
 
 var (
@@ -44,10 +48,10 @@ type tcpBufCache struct {
 
 // newTCPBufCache return a new tcpBuf cache.
 func newtcpBufCache() *tcpBufCache {
-	inst := make([]chan *bufio.Reader, 0, Conf.BufioInstance)
-	log.Debug("create %d read buffer instance", Conf.BufioInstance)
-	for i := 0; i < Conf.BufioInstance; i++ {
-		inst = append(inst, make(chan *bufio.Reader, Conf.BufioNum))
+	inst := make([]chan *bufio.Reader, 0, Conf().BufioInstance)
+	log.Debug("create %d read buffer instance", Conf().BufioInstance)
+	for i := 0; i < Conf().BufioInstance; i++ {
+		inst = append(inst, make(chan *bufio.Reader, Conf().BufioNum))
 	}
 	return &tcpBufCache{instance: inst, round: 0}
 }
@@ -56,7 +60,7 @@ func newtcpBufCache() *tcpBufCache {
 func (b *tcpBufCache) Get() chan *bufio.Reader {
 	rc := b.instance[b.round]
 	// split requets to diff buffer chan
-	if b.round++; b.round == Conf.BufioInstance {
+	if b.round++; b.round == Conf().BufioInstance {
 		b.round = 0
 	}
 	return rc
@@ -70,10 +74,22 @@ func newBufioReader(c chan *bufio.Reader, r io.Reader) *bufio.Reader {
 		return p
 	default:
 		log.Warn("tcp bufioReader cache empty")
-		return bufio.NewReaderSize(r, Conf.RcvbufSize)
+		return bufio.NewReaderSize(r, Conf().RcvbufSize)
 	}
 }
 
+// connBufioReader new a Reader owned by the subscribed connection, the pooled
+// Reader is only used by the first command, so it's put back at once. The
+// bytes buffered by the pooled Reader are read first.
+func connBufioReader(rd *bufio.Reader, conn net.Conn) *bufio.Reader {
+	var r io.Reader = conn
+	if n := rd.Buffered(); n > 0 {
+		b, _ := rd.Peek(n)
+		r = io.MultiReader(bytes.NewReader(append([]byte(nil), b...)), conn)
+	}
+	return bufio.NewReaderSize(r, Conf().RcvbufSize)
+}
+
 // putBufioReader pub back a Reader to chan, if chan full discard it.
 func putBufioReader(c chan *bufio.Reader, r *bufio.Reader) {
 	r.Reset(nil)
@@ -86,15 +102,26 @@ func putBufioReader(c chan *bufio.Reader, r *bufio.Reader) {
 
 // StartTCP Start tcp listen.
 func StartTCP() error {
-	for _, bind := range Conf.TCPBind {
+	for _, bind := range Conf().TCPBind {
 		log.Info("start tcp listen addr:\"%s\"", bind)
-		go tcpListen(bind)
+		go tcpListen(bind, false, handleTCPConn)
+	}
+	for _, bind := range Conf().TCPTLSBind {
+		log.Info("start tcp tls listen addr:\"%s\"", bind)
+		go tcpListen(bind, true, handleTCPConn)
+	}
+	for _, bind := range Conf().TCPV2Bind {
+		log.Info("start tcp binary(v2) listen addr:\"%s\"", bind)
+		go tcpListen(bind, false, handleBinaryConn)
 	}
 
 	return nil
 }
 
-func tcpListen(bind string) {
+// tcpConnHandler handle a accepted tcp connection by the listener protocol.
+type tcpConnHandler func(net.Conn, chan *bufio.Reader)
+
+func tcpListen(bind string, secure bool, handler tcpConnHandler) {
 	addr, err := net.ResolveTCPAddr("tcp", bind)
 	if err != nil {
 		log.Error("net.ResolveTCPAddr(\"tcp\"), %s) error(%v)", bind, err)
@@ -105,34 +132,43 @@ func tcpListen(bind string) {
 		log.Error("net.ListenTCP(\"tcp4\", \"%s\") error(%v)", bind, err)
 		panic(err)
 	}
+	addListener(l)
 	// free the listener resource
 	defer func() {
 		log.Info("tcp addr: \"%s\" close", bind)
-		if err := l.Close(); err != nil {
+		if err := l.Close(); err != nil && !Draining() {
 			log.Error("listener.Close() error(%v)", err)
 		}
 	}()
+	var tlsConf *tls.Config
+	if secure {
+		tlsConf = tlsCert.Config()
+	}
 	// init reader buffer instance
 	rb := newtcpBufCache()
 	for {
 		log.Debug("start accept")
 		conn, err := l.AcceptTCP()
 		if err != nil {
+			if Draining() {
+				log.Info("tcp addr: \"%s\" stop accept", bind)
+				return
+			}
 			log.Error("listener.AcceptTCP() error(%v)", err)
 			continue
 		}
-		if err = conn.SetKeepAlive(Conf.TCPKeepalive); err != nil {
+		if err = conn.SetKeepAlive(Conf().TCPKeepalive); err != nil {
 			log.Error("conn.SetKeepAlive() error(%v)", err)
 			conn.Close()
 			continue
 		}
-		if err = conn.SetReadBuffer(Conf.RcvbufSize); err != nil {
-			log.Error("conn.SetReadBuffer(%d) error(%v)", Conf.RcvbufSize, err)
+		if err = conn.SetReadBuffer(Conf().RcvbufSize); err != nil {
+			log.Error("conn.SetReadBuffer(%d) error(%v)", Conf().RcvbufSize, err)
 			conn.Close()
 			continue
 		}
-		if err = conn.SetWriteBuffer(Conf.SndbufSize); err != nil {
-			log.Error("conn.SetWriteBuffer(%d) error(%v)", Conf.SndbufSize, err)
+		if err = conn.SetWriteBuffer(Conf().SndbufSize); err != nil {
+			log.Error("conn.SetWriteBuffer(%d) error(%v)", Conf().SndbufSize, err)
 			conn.Close()
 			continue
 		}
@@ -144,7 +180,12 @@ func tcpListen(bind string) {
 		}
 		rc := rb.Get()
 		// one connection one routine
-		go handleTCPConn(conn, rc)
+		if secure {
+			// the handshake is done by the first read in the routine
+			go handler(tls.Server(conn, tlsConf), rc)
+		} else {
+			go handler(conn, rc)
+		}
 		log.Debug("accept finished")
 	}
 }
@@ -155,11 +196,13 @@ func handleTCPConn(conn net.Conn, rc chan *bufio.Reader) {
 	log.Debug("<%s> handleTcpConn routine start", addr)
 	rd := newBufioReader(rc, conn)
 	if args, err := parseCmd(rd); err == nil {
+		// the command loop reads by the connection own reader
+		crd := connBufioReader(rd, conn)
 		// return buffer bufio.Reader
 		putBufioReader(rc, rd)
 		switch args[0] {
 		case "sub":
-			SubscribeTCPHandle(conn, args[1:])
+			SubscribeTCPHandle(conn, crd, args[1:])
 			break
 		default:
 			conn.Write(ParamReply)
@@ -180,7 +223,7 @@ func handleTCPConn(conn net.Conn, rc chan *bufio.Reader) {
 }
 
 // SubscribeTCPHandle handle the subscribers's connection.
-func SubscribeTCPHandle(conn net.Conn, args []string) {
+func SubscribeTCPHandle(conn net.Conn, rd *bufio.Reader, args []string) {
 	argLen := len(args)
 	addr := conn.RemoteAddr().String()
 	if argLen < 2 {
@@ -216,33 +259,50 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 	if argLen > 3 {
 		version = args[3]
 	}
-	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s", addr, key, heartbeat, token, version)
-	// fetch subscriber from the channel
-	c, err := UserChannel.Get(key, true)
+	caps := ""
+	if argLen > 4 {
+		caps = args[4]
+	}
+	// replay the offline private messages after the mid
+	replay := false
+	lastMid := int64(0)
+	if argLen > 5 {
+		if lastMid, err = strconv.ParseInt(args[5], 10, 64); err != nil || lastMid < 0 {
+			conn.Write(ParamReply)
+			log.Error("<%s> user_key:\"%s\" mid:\"%s\" argument error (%v)", addr, key, args[5], err)
+			return
+		}
+		replay = true
+	}
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s, caps = %s", addr, key, heartbeat, token, version, caps)
+	// fetch subscriber from the channel and auth token
+	c, attrs, err := UserChannel.GetAuth(key, token)
 	if err != nil {
 		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
 		if err == ErrChannelKey {
 			conn.Write(NodeReply)
+		} else if err == ErrChannelAuth {
+			conn.Write(AuthReply)
 		} else {
 			conn.Write(ChannelReply)
 		}
 		return
 	}
-	// auth token
-	if ok := c.AuthToken(key, token); !ok {
-		conn.Write(AuthReply)
-		log.Error("<%s> user_key:\"%s\" auth token \"%s\" failed", addr, key, token)
-		return
-	}
 	// add a conn to the channel
-	connElem, err := c.AddConn(key, &Connection{Conn: conn, Proto: TCPProto, Version: version})
+	_, secure := conn.(*tls.Conn)
+	connection := &Connection{Conn: conn, Proto: TCPProto, Version: version, TLS: secure, Encoding: parseCaps(caps), Replay: replay, LastMid: lastMid, attrs: attrs}
+	c, connElem, err := UserChannel.AddConn(key, c, connection)
 	if err != nil {
 		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
 		return
 	}
-	// blocking wait client heartbeat
-	reply := []byte{0}
-	// reply := make([]byte, HeartbeatLen)
+	// blocking wait client heartbeat or command
+	var (
+		reply    byte
+		cmd      []string
+		cmdReply []byte
+		quit     bool
+	)
 	begin := time.Now().UnixNano()
 	end := begin + Second
 	for {
@@ -254,7 +314,7 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 			}
 			begin = end
 		}
-		if _, err = conn.Read(reply); err != nil {
+		if reply, err = rd.ReadByte(); err != nil {
 			if err != io.EOF {
 				log.Warn("<%s> user_key:\"%s\" conn.Read() failed, read heartbeat timedout error(%v)", addr, key, err)
 			} else {
@@ -263,14 +323,30 @@ func SubscribeTCPHandle(conn net.Conn, args []string) {
 			}
 			break
 		}
-		if string(reply) == Heartbeat {
+		if reply == Heartbeat[0] {
 			if _, err = conn.Write(HeartbeatReply); err != nil {
 				log.Error("<%s> user_key:\"%s\" conn.Write() failed, write heartbeat to client error(%v)", addr, key, err)
 				break
 			}
-			log.Debug("<%s> user_key:\"%s\" receive heartbeat (%s)", addr, key, reply)
+			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+		} else if reply == '*' {
+			// command, eg: join a topic or publish to server
+			rd.UnreadByte()
+			if cmd, err = parseCmd(rd); err != nil {
+				log.Error("<%s> user_key:\"%s\" parseCmd() error(%v)", addr, key, err)
+				break
+			}
+			cmdReply, quit = handleCmd(key, c, connection, cmd)
+			if _, err = conn.Write(cmdReply); err != nil {
+				log.Error("<%s> user_key:\"%s\" conn.Write() failed, write cmd reply to client error(%v)", addr, key, err)
+				break
+			}
+			if quit {
+				log.Info("<%s> user_key:\"%s\" unsubscribe", addr, key)
+				break
+			}
 		} else {
-			log.Warn("<%s> user_key:\"%s\" unknown heartbeat protocol (%s)", addr, key, reply)
+			log.Warn("<%s> user_key:\"%s\" unknown heartbeat protocol (%c)", addr, key, reply)
 			break
 		}
 		end = time.Now().UnixNano()
@@ -316,10 +392,10 @@ func parseCmd(rd *bufio.Reader) ([]string, error) {
 
 // parseCmdSize get the request protocol cmd size.
 func parseCmdSize(rd *bufio.Reader, prefix uint8) (int, error) {
-	// get command size
-	cs, err := rd.ReadBytes('\n')
+	// get command size, the line is bounded by the bufio buffer
+	cs, err := rd.ReadSlice('\n')
 	if err != nil {
-		log.Error("tcp:rd.ReadBytes('\\n') error(%v)", err)
+		log.Error("tcp:rd.ReadSlice('\\n') error(%v)", err)
 		return 0, err
 	}
 	csl := len(cs)
@@ -338,14 +414,18 @@ func parseCmdSize(rd *bufio.Reader, prefix uint8) (int, error) {
 
 // parseCmdData get the sub request protocol cmd data not included \r\n.
 func parseCmdData(rd *bufio.Reader, cmdLen int) ([]byte, error) {
-	d, err := rd.ReadBytes('\n')
-	if err != nil {
-		log.Error("tcp:rd.ReadBytes('\\n') error(%v)", err)
+	if cmdLen < 0 || cmdLen > maxCmdLen {
+		log.Error("tcp:cmd length: %d exceed the limit: %d", cmdLen, maxCmdLen)
+		return nil, ErrProtocol
+	}
+	d := make([]byte, cmdLen+2)
+	if _, err := io.ReadFull(rd, d); err != nil {
+		log.Error("tcp:io.ReadFull() error(%v)", err)
 		return nil, err
 	}
 	dl := len(d)
 	// check last \r\n
-	if dl != cmdLen+2 || d[dl-2] != '\r' {
+	if d[dl-2] != '\r' || d[dl-1] != '\n' {
 		log.Error("tcp:\"%v\"(%d) number format error, length error or no \\r", d, dl)
 		return nil, ErrProtocol
 	}
@@ -17,6 +17,8 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"net"
 	"net/http"
 	"strconv"
@@ -52,33 +54,42 @@ func (l *KeepAliveListener) Accept() (c net.Conn, err error) {
 
 // StartHttp start http listen.
 func StartWebsocket() error {
-	for _, bind := range Conf.WebsocketBind {
+	for _, bind := range Conf().WebsocketBind {
 		log.Info("start websocket listen addr:\"%s\"", bind)
-		go websocketListen(bind)
+		go websocketListen(bind, false)
+	}
+	for _, bind := range Conf().WebsocketTLSBind {
+		log.Info("start websocket tls listen addr:\"%s\"", bind)
+		go websocketListen(bind, true)
 	}
 
 	return nil
 }
 
-func websocketListen(bind string) {
+func websocketListen(bind string, secure bool) {
 	httpServeMux := http.NewServeMux()
-	httpServeMux.Handle("/sub", websocket.Handler(SubscribeHandle))
-	if Conf.TCPKeepalive {
-		server := &http.Server{Handler: httpServeMux}
-		l, err := net.Listen("tcp", bind)
-		if err != nil {
-			log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
-			panic(err)
-		}
-		if err := server.Serve(&KeepAliveListener{Listener: l}); err != nil {
-			log.Error("server.Serve(\"%s\") error(%v)", bind, err)
-			panic(err)
-		}
-	} else {
-		if err := http.ListenAndServe(bind, httpServeMux); err != nil {
-			log.Error("http.ListenAdServe(\"%s\") error(%v)", bind, err)
-			panic(err)
+	// websocket.Server with the permessage-deflate negotiation
+	httpServeMux.Handle("/sub", websocket.Server{Handler: SubscribeHandle, Handshake: wsHandshake})
+	server := &http.Server{Handler: httpServeMux, ConnContext: wsConnContext}
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+	addListener(l)
+	if Conf().TCPKeepalive {
+		l = &KeepAliveListener{Listener: l}
+	}
+	if secure {
+		l = tls.NewListener(l, tlsCert.Config())
+	}
+	if err := server.Serve(l); err != nil {
+		if Draining() {
+			log.Info("websocket addr: \"%s\" stop accept", bind)
+			return
 		}
+		log.Error("server.Serve(\"%s\") error(%v)", bind, err)
+		panic(err)
 	}
 }
 
@@ -109,32 +120,59 @@ func SubscribeHandle(ws *websocket.Conn) {
 	heartbeat := i + delayHeartbeatSec
 	token := params.Get("token")
 	version := params.Get("ver")
-	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s", addr, key, heartbeat, token, version)
-	// fetch subscriber from the channel
-	c, err := UserChannel.Get(key, true)
+	caps := params.Get("caps")
+	// replay the offline private messages after the mid
+	replay := false
+	lastMid := int64(0)
+	if midStr := params.Get("mid"); midStr != "" {
+		if lastMid, err = strconv.ParseInt(midStr, 10, 64); err != nil || lastMid < 0 {
+			ws.Write(ParamReply)
+			log.Error("<%s> user_key:\"%s\" mid:\"%s\" argument error(%v)", addr, key, midStr, err)
+			return
+		}
+		replay = true
+	}
+	log.Info("<%s> subscribe to key = %s, heartbeat = %d, token = %s, version = %s, caps = %s", addr, key, heartbeat, token, version, caps)
+	// the permessage-deflate negotiated connection writes the frames itself
+	var (
+		conn     net.Conn = ws
+		dc       *wsDeflateConn
+		encoding = parseCaps(caps)
+	)
+	if wsDeflated(ws) {
+		if dc, err = newWSDeflateConn(ws); err != nil {
+			log.Error("<%s> user_key:\"%s\" newWSDeflateConn() error(%v)", addr, key, err)
+			return
+		}
+		conn, encoding = dc, EncodingWSDeflate
+	}
+	// fetch subscriber from the channel and auth token
+	c, attrs, err := UserChannel.GetAuth(key, token)
 	if err != nil {
 		log.Warn("<%s> user_key:\"%s\" can't get a channel (%s)", addr, key, err)
 		if err == ErrChannelKey {
 			ws.Write(NodeReply)
+		} else if err == ErrChannelAuth {
+			ws.Write(AuthReply)
 		} else {
 			ws.Write(ChannelReply)
 		}
 		return
 	}
-	// auth token
-	if ok := c.AuthToken(key, token); !ok {
-		ws.Write(AuthReply)
-		log.Error("<%s> user_key:\"%s\" auth token \"%s\" failed", addr, key, token)
-		return
-	}
 	// add a conn to the channel
-	connElem, err := c.AddConn(key, &Connection{Conn: ws, Proto: WebsocketProto, Version: version})
+	connection := &Connection{Conn: conn, Proto: WebsocketProto, Version: version, TLS: ws.Request().TLS != nil, Encoding: encoding, Replay: replay, LastMid: lastMid, attrs: attrs}
+	c, connElem, err := UserChannel.AddConn(key, c, connection)
 	if err != nil {
 		log.Error("<%s> user_key:\"%s\" add conn error(%v)", addr, key, err)
 		return
 	}
-	// blocking wait client heartbeat
-	reply := ""
+	// blocking wait client heartbeat or command
+	var (
+		reply    string
+		cmd      []string
+		cmdReply []byte
+		quit     bool
+	)
 	begin := time.Now().UnixNano()
 	end := begin + Second
 	for {
@@ -146,16 +184,37 @@ func SubscribeHandle(ws *websocket.Conn) {
 			}
 			begin = end
 		}
-		if err = websocket.Message.Receive(ws, &reply); err != nil {
+		if dc != nil {
+			reply, err = dc.ReadMessage()
+		} else {
+			err = websocket.Message.Receive(ws, &reply)
+		}
+		if err != nil {
 			log.Error("<%s> user_key:\"%s\" websocket.Message.Receive() error(%v)", addr, key, err)
 			break
 		}
 		if reply == Heartbeat {
-			if _, err = ws.Write(HeartbeatReply); err != nil {
+			if _, err = conn.Write(HeartbeatReply); err != nil {
 				log.Error("<%s> user_key:\"%s\" write heartbeat to client error(%s)", addr, key, err)
 				break
 			}
 			log.Debug("<%s> user_key:\"%s\" receive heartbeat", addr, key)
+		} else if len(reply) > 0 && reply[0] == '[' {
+			// command, eg: ["join", "score.*"] or ["pub", "{\"test\":1}"]
+			cmd = nil
+			if err = json.Unmarshal([]byte(reply), &cmd); err != nil {
+				log.Error("<%s> user_key:\"%s\" json.Unmarshal(\"%s\") error(%v)", addr, key, reply, err)
+				break
+			}
+			cmdReply, quit = handleCmd(key, c, connection, cmd)
+			if _, err = conn.Write(cmdReply); err != nil {
+				log.Error("<%s> user_key:\"%s\" write cmd reply to client error(%s)", addr, key, err)
+				break
+			}
+			if quit {
+				log.Info("<%s> user_key:\"%s\" unsubscribe", addr, key)
+				break
+			}
 		} else {
 			log.Warn("<%s> user_key:\"%s\" unknown heartbeat protocol", addr, key)
 			break
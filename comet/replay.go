@@ -0,0 +1,174 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"time"
+)
+
+const (
+	// the interval of checking the connection buf has room for the page
+	replayCheckInterval = 50 * time.Millisecond
+	// the retry times of getting a page, then the connection is closed
+	replayRetry = 3
+)
+
+// heldMsg is a stored private message pushed while the connection replaying.
+type heldMsg struct {
+	m   *myrpc.Message
+	msg []byte
+}
+
+// hold keep the stored private message pushed while replaying, it's written
+// after the backlog. The held messages are bounded by the connection buf, if
+// overflowed they're dropped and got from the storage by the replay again.
+// Called under the channel lock.
+func (c *Connection) hold(key string, m *myrpc.Message, msg []byte) {
+	if c.heldOverflow || len(c.held) >= cap(c.Buf) {
+		if !c.heldOverflow {
+			log.Debug("user_key: \"%s\" replay held messages overflow at mid:%d", key, m.MsgId)
+		}
+		c.heldOverflow = true
+		c.held = nil
+		return
+	}
+	c.held = append(c.held, &heldMsg{m: m, msg: msg})
+}
+
+// replay write the stored private messages after the last mid got by the
+// client to the connection. The backlog is got page by page out of the
+// channel lock, a page is at most the connection buf size and written when
+// the buf has room for it. The stored private messages pushed meanwhile are
+// held by the connection and written after the backlog, so the client gets
+// the backlog in front of the live messages. If a page can't be got, the
+// client is told to reconnect, it replays again from its last mid.
+func (c *SeqChannel) replay(key string, conn *Connection) {
+	var (
+		mid      = conn.LastMid
+		n        = 0
+		replayed = map[int64]bool{}
+	)
+	for {
+		msgs, cursor, err := getPrivate(key, mid, cap(conn.Buf))
+		for i := 0; err != nil && i < replayRetry; i++ {
+			time.Sleep(replayCheckInterval)
+			msgs, cursor, err = getPrivate(key, mid, cap(conn.Buf))
+		}
+		if err != nil {
+			MsgStat.IncrReplayFailed(1)
+			c.replayFailed(key, conn)
+			return
+		}
+		// wait the connection buf has room for the page
+		for len(conn.Buf) > 0 && len(conn.Buf)+len(msgs) > cap(conn.Buf) {
+			time.Sleep(replayCheckInterval)
+			if !c.replaying(conn) {
+				return
+			}
+		}
+		c.mutex.Lock()
+		// the connection removed
+		if !conn.replaying {
+			c.mutex.Unlock()
+			return
+		}
+		for _, m := range msgs {
+			m.Stored = true
+			replayed[m.MsgId] = true
+			msg, err := newMsgEncoder(m).Bytes(conn)
+			if err != nil {
+				log.Error("user_key: \"%s\" encode mid:%d error(%v)", key, m.MsgId, err)
+				continue
+			}
+			conn.WriteAck(key, m, msg)
+		}
+		n += len(msgs)
+		if cursor > 0 {
+			mid = cursor
+		} else if len(msgs) > 0 {
+			mid = msgs[len(msgs)-1].MsgId
+		}
+		// get the next page, or the held messages overflowed
+		if cursor > 0 || conn.heldOverflow {
+			conn.heldOverflow = false
+			c.mutex.Unlock()
+			continue
+		}
+		// the backlog replayed, the held messages after it
+		for _, h := range conn.held {
+			if !replayed[h.m.MsgId] {
+				conn.WriteAck(key, h.m, h.msg)
+			}
+		}
+		conn.replaying = false
+		conn.held = nil
+		c.mutex.Unlock()
+		break
+	}
+	MsgStat.IncrReplayed(uint64(n))
+	log.Debug("user_key: \"%s\" replay %d messages after mid:%d", key, n, conn.LastMid)
+}
+
+// replayFailed drop the held messages (they're after the lost backlog) and
+// tell the client to reconnect, the connection is removed by the reading
+// goroutine.
+func (c *SeqChannel) replayFailed(key string, conn *Connection) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !conn.replaying {
+		return
+	}
+	// keep replaying, the later pushes are dropped too
+	conn.held = nil
+	conn.heldOverflow = true
+	if _, err := conn.Conn.Write(conn.redirectReply("")); err != nil {
+		log.Warn("user_key:\"%s\" write redirect to client error(%v)", key, err)
+	}
+	if err := conn.Conn.Close(); err != nil {
+		log.Warn("user_key:\"%s\" conn.Close() error(%v)", key, err)
+	}
+	log.Warn("user_key:\"%s\" replay after mid:%d failed, close the connection", key, conn.LastMid)
+}
+
+// replaying check the connection is replaying and not removed.
+func (c *SeqChannel) replaying(conn *Connection) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return conn.replaying
+}
+
+// getPrivate get a page of the stored private messages after mid, return the
+// cursor of the next page, 0 means no more messages.
+func getPrivate(key string, mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("user_key: \"%s\" get private mid:%d error(%v)", key, mid, ErrMessageRPC)
+		return nil, 0, ErrMessageRPC
+	}
+	args := &myrpc.MessageGetPrivateArgs{MsgId: mid, Key: key, Limit: limit}
+	reply := &myrpc.MessageGetResp{}
+	if err := client.Call(myrpc.MessageServiceGetPrivate, args, reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPrivate, args, err)
+		return nil, 0, err
+	}
+	if !reply.HasMore {
+		return reply.Msgs, 0, nil
+	}
+	return reply.Msgs, reply.Cursor, nil
+}
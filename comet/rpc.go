@@ -23,6 +23,7 @@ import (
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	"net"
 	"net/rpc"
+	"strings"
 	"sync"
 )
 
@@ -34,7 +35,7 @@ var (
 func StartRPC() error {
 	c := &CometRPC{}
 	rpc.Register(c)
-	for _, bind := range Conf.RPCBind {
+	for _, bind := range Conf().RPCBind {
 		log.Info("start listen rpc addr: \"%s\"", bind)
 		go rpcListen(bind)
 	}
@@ -73,8 +74,17 @@ func (c *CometRPC) New(args *myrpc.CometNewArgs, ret *int) error {
 		log.Error("UserChannel.New(\"%s\") error(%v)", args.Key, err)
 		return err
 	}
-	if err = ch.AddToken(args.Key, args.Token); err != nil {
-		log.Error("ch.AddToken(\"%s\", \"%s\") error(%v)", args.Key, args.Token)
+	err = ch.AddToken(args.Key, args.Token)
+	if err == ErrChannelExpired {
+		// evicted by the idle expiry after got, create it again
+		if ch, _, err = UserChannel.New(args.Key); err != nil {
+			log.Error("UserChannel.New(\"%s\") error(%v)", args.Key, err)
+			return err
+		}
+		err = ch.AddToken(args.Key, args.Token)
+	}
+	if err != nil {
+		log.Error("ch.AddToken(\"%s\", \"%s\") error(%v)", args.Key, args.Token, err)
 		return err
 	}
 	return nil
@@ -99,6 +109,75 @@ func (c *CometRPC) Close(key string, ret *int) error {
 	return nil
 }
 
+// News expored a method for creating multiple channels and registering the
+// tokens, the failed keys are returned.
+func (c *CometRPC) News(args *myrpc.CometNewsArgs, rw *myrpc.CometBatchResp) error {
+	if args == nil {
+		return myrpc.ErrParam
+	}
+	ret := 0
+	for key, token := range args.Tokens {
+		if err := c.New(&myrpc.CometNewArgs{Key: key, Token: token}, &ret); err != nil {
+			rw.FKeys = append(rw.FKeys, key)
+		}
+	}
+	return nil
+}
+
+// Closes expored a method for closing multiple channels, the failed keys are
+// returned.
+func (c *CometRPC) Closes(keys []string, rw *myrpc.CometBatchResp) error {
+	ret := 0
+	for _, key := range keys {
+		if err := c.Close(key, &ret); err != nil {
+			rw.FKeys = append(rw.FKeys, key)
+		}
+	}
+	return nil
+}
+
+// Kick expored a method for disconnecting all the connections of the key, the
+// channel and the offline messages are kept.
+func (c *CometRPC) Kick(args *myrpc.CometKickArgs, ret *int) error {
+	if args == nil || args.Key == "" || strings.ContainsAny(args.Reason, "\r\n") {
+		return myrpc.ErrParam
+	}
+	// the connections are kicked even if the revocation not saved, the error
+	// is returned to retry
+	var rerr error
+	if args.Revoke {
+		authCache.DeleteKey(args.Key)
+		if rerr = revokeSigned(args.Key); rerr != nil {
+			log.Error("user_key:\"%s\" revokeSigned() error(%v)", args.Key, rerr)
+		}
+	}
+	ch, err := UserChannel.Get(args.Key, false)
+	if err != nil {
+		// no channel no connection
+		log.Debug("user_key:\"%s\" kick skipped (%v)", args.Key, err)
+		return rerr
+	}
+	if err = ch.Kick(args.Key, args.Reason, args.Revoke); err != nil {
+		return err
+	}
+	return rerr
+}
+
+// Online expored a method for getting the connection counts and protocols of
+// multiple keys, the keys without channel are offline.
+func (c *CometRPC) Online(keys []string, rw *myrpc.CometOnlineResp) error {
+	rw.Keys = make(map[string]*myrpc.CometOnline, len(keys))
+	for _, key := range keys {
+		ch, err := UserChannel.Get(key, false)
+		if err != nil {
+			rw.Keys[key] = &myrpc.CometOnline{Proto: map[string]int{}}
+			continue
+		}
+		rw.Keys[key] = ch.Online()
+	}
+	return nil
+}
+
 // PushPrivate expored a method for publishing a user private message for the channel.
 // if it`s going failed then it`ll return an error
 func (c *CometRPC) PushPrivate(args *myrpc.CometPushPrivateArgs, ret *int) error {
@@ -132,7 +211,7 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 	if args == nil {
 		return myrpc.ErrParam
 	}
-	bucketMap := make(map[*ChannelBucket]*batchChannel, Conf.ChannelBucket)
+	bucketMap := make(map[*ChannelBucket]*batchChannel, Conf().ChannelBucket)
 	for _, key := range args.Keys {
 		// get channel
 		ch, bp, err := UserChannel.New(key)
@@ -175,7 +254,7 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 			b.Lock()
 			defer b.Unlock()
 			timeId := id.Get()
-			msg := &myrpc.Message{Msg: args.Msg, MsgId: timeId}
+			msg := &myrpc.Message{Msg: args.Msg, MsgId: timeId, Stored: args.Expire > 0}
 			// private message need persistence
 			// if message expired no need persistence, only send online message
 			// rewrite message id
@@ -198,7 +277,12 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 			}
 			// get all channels from batchChannel chs.
 			for key, ch := range m.Chs {
-				if err := ch.WriteMsg(key, msg); err != nil {
+				kmsg := msg
+				if seq, ok := resp.Seqs[key]; ok {
+					// the sequence is different for every key
+					kmsg = &myrpc.Message{Msg: args.Msg, MsgId: timeId, Seq: seq, Stored: true}
+				}
+				if err := ch.WriteMsg(key, kmsg); err != nil {
 					// ignore online push error, cause offline msg succeed
 					log.Error("ch.WriteMsg(\"%s\", \"%s\") error(%v)", key, string(msg.Msg), err)
 					continue
@@ -215,9 +299,87 @@ func (c *CometRPC) PushPrivates(args *myrpc.CometPushPrivatesArgs, rw *myrpc.Com
 	return nil
 }
 
+// PushPublic expored a method for publishing a public message to all the channels.
+// the message already persistenced by caller, so only send online message.
+func (c *CometRPC) PushPublic(args *myrpc.CometPushPublicArgs, ret *int) error {
+	if args == nil || args.Msg == nil {
+		return myrpc.ErrParam
+	}
+	msg := &myrpc.Message{Msg: args.Msg, MsgId: args.MsgId, GroupId: myrpc.PublicGroupId, Stored: args.Expire > 0}
+	// every bucket start a goroutine, return till all bucket gorouint finish
+	wg := &sync.WaitGroup{}
+	wg.Add(len(UserChannel.Channels))
+	for _, tb := range UserChannel.Channels {
+		go func(b *ChannelBucket) {
+			defer wg.Done()
+			// copy the channels, avoid holding the bucket lock when writing
+			b.Lock()
+			chs := make(map[string]Channel, len(b.Data))
+			for key, ch := range b.Data {
+				chs[key] = ch
+			}
+			b.Unlock()
+			for key, ch := range chs {
+				if err := ch.WriteMsg(key, msg); err != nil {
+					log.Error("ch.WriteMsg(\"%s\", \"%s\") error(%v)", key, string(msg.Msg), err)
+					continue
+				}
+			}
+		}(tb)
+	}
+	wg.Wait()
+	return nil
+}
+
+// PushGroup expored a method for publishing a group message to the online members.
+// the message already persistenced by caller, offline members get it by mid.
+func (c *CometRPC) PushGroup(args *myrpc.CometPushGroupArgs, ret *int) error {
+	if args == nil || args.Msg == nil {
+		return myrpc.ErrParam
+	}
+	msg := &myrpc.Message{Msg: args.Msg, MsgId: args.MsgId, GroupId: args.GroupId, Stored: args.Expire > 0}
+	for _, key := range args.Keys {
+		// don't create channel for the offline members
+		ch, err := UserChannel.Get(key, false)
+		if err != nil {
+			log.Debug("user_key:\"%s\" skip group:%d message (%v)", key, args.GroupId, err)
+			continue
+		}
+		if err = ch.WriteMsg(key, msg); err != nil {
+			log.Error("ch.WriteMsg(\"%s\", \"%s\") error(%v)", key, string(msg.Msg), err)
+			continue
+		}
+	}
+	return nil
+}
+
+// PublishTopic expored a method for publishing a message to the topic subscribers.
+// the topic message is not stored, return the number of written connections.
+func (c *CometRPC) PublishTopic(args *myrpc.CometPublishTopicArgs, ret *int) error {
+	if args == nil || args.Msg == nil {
+		return myrpc.ErrParam
+	}
+	msg := &myrpc.Message{Msg: args.Msg, Topic: args.Topic}
+	n, err := UserTopic.Publish(args.Topic, msg)
+	if err != nil {
+		log.Error("UserTopic.Publish(\"%s\", \"%s\") error(%v)", args.Topic, string(args.Msg), err)
+		return err
+	}
+	*ret = n
+	return nil
+}
+
 // Migrate update the inner hashring and node info.
 func (c *CometRPC) Migrate(args *myrpc.CometMigrateArgs, ret *int) error {
-	return UserChannel.Migrate(args.Nodes)
+	return UserChannel.Migrate(args.Nodes, args.Addrs)
+}
+
+// Drain expored a method for draining the comet, used by rolling deploys.
+// the comet will exit after drained.
+func (c *CometRPC) Drain(args int, ret *int) error {
+	log.Info("receive a drain request")
+	RequestDrain()
+	return nil
 }
 
 // Ping check health.
@@ -22,7 +22,9 @@ import (
 	"github.com/Terry-Mao/gopush-cluster/hlist"
 	"github.com/Terry-Mao/gopush-cluster/id"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 var (
@@ -42,6 +44,10 @@ type SeqChannel struct {
 	// timeID *id.TimeID
 	// token
 	token *Token
+	// last active time, the connection removed or token added
+	last time.Time
+	// evicted by the idle expiration
+	expired bool
 }
 
 // New a user seq stored message channel.
@@ -51,9 +57,10 @@ func NewSeqChannel() *SeqChannel {
 		conn:  hlist.New(),
 		//timeID: id.NewTimeID(),
 		token: nil,
+		last:  time.Now(),
 	}
 	// save memory
-	if Conf.Auth {
+	if Conf().Auth {
 		ch.token = NewToken()
 	}
 	return ch
@@ -61,10 +68,15 @@ func NewSeqChannel() *SeqChannel {
 
 // AddToken implements the Channel AddToken method.
 func (c *SeqChannel) AddToken(key, token string) error {
-	if !Conf.Auth {
+	if !Conf().Auth {
 		return nil
 	}
 	c.mutex.Lock()
+	if c.expired {
+		c.mutex.Unlock()
+		return ErrChannelExpired
+	}
+	c.last = time.Now()
 	if err := c.token.Add(token); err != nil {
 		c.mutex.Unlock()
 		log.Error("user_key:\"%s\" c.token.Add(\"%s\") error(%v)", key, token, err)
@@ -75,18 +87,26 @@ func (c *SeqChannel) AddToken(key, token string) error {
 }
 
 // AuthToken implements the Channel AuthToken method.
-func (c *SeqChannel) AuthToken(key, token string) bool {
-	if !Conf.Auth {
-		return true
+func (c *SeqChannel) AuthToken(key, token string) (map[string]string, bool) {
+	if !Conf().Auth {
+		return nil, true
+	}
+	if Conf().AuthMode != AuthModeToken {
+		attrs, err := authStateless(key, token)
+		if err != nil {
+			log.Error("user_key:\"%s\" auth %s token \"%s\" error(%v)", key, Conf().AuthMode, token, err)
+			return nil, false
+		}
+		return attrs, true
 	}
 	c.mutex.Lock()
 	if err := c.token.Auth(token); err != nil {
 		c.mutex.Unlock()
 		log.Error("user_key:\"%s\" c.token.Auth(\"%s\") error(%v)", key, token, err)
-		return false
+		return nil, false
 	}
 	c.mutex.Unlock()
-	return true
+	return nil, true
 }
 
 // WriteMsg implements the Channel WriteMsg method.
@@ -100,29 +120,27 @@ func (c *SeqChannel) WriteMsg(key string, m *myrpc.Message) (err error) {
 // writeMsg write msg to conn.
 func (c *SeqChannel) writeMsg(key string, m *myrpc.Message) (err error) {
 	var (
-		oldMsg, msg, sendMsg []byte
+		sendMsg []byte
+		enc     = newMsgEncoder(m)
 	)
 	// push message
 	for e := c.conn.Front(); e != nil; e = e.Next() {
 		conn, _ := e.Value.(*Connection)
-		// if version empty then use old protocol
-		if conn.Version == "" {
-			if oldMsg == nil {
-				if oldMsg, err = m.OldBytes(); err != nil {
-					return
-				}
-			}
-			sendMsg = oldMsg
-		} else {
-			if msg == nil {
-				if msg, err = m.Bytes(); err != nil {
-					return
-				}
-			}
-			sendMsg = msg
+		if sendMsg, err = enc.Bytes(conn); err != nil {
+			return
+		}
+		// written after the replayed backlog
+		if conn.replaying && m.GroupId == myrpc.PrivateGroupId && m.Stored {
+			conn.hold(key, m, sendMsg)
+			continue
 		}
 		// TODO use goroutine
-		conn.Write(key, sendMsg)
+		if m.GroupId == myrpc.PrivateGroupId && m.MsgId > 0 {
+			// private message need client ack
+			conn.WriteAck(key, m, sendMsg)
+		} else {
+			conn.Write(key, m, sendMsg)
+		}
 	}
 	return
 }
@@ -141,12 +159,14 @@ func (c *SeqChannel) PushMsg(key string, m *myrpc.Message, expire uint) (err err
 	m.MsgId = id.Get()
 	if m.GroupId != myrpc.PublicGroupId && expire > 0 {
 		args := &myrpc.MessageSavePrivateArgs{Key: key, Msg: m.Msg, MsgId: m.MsgId, Expire: expire}
-		ret := 0
-		if err = client.Call(myrpc.MessageServiceSavePrivate, args, &ret); err != nil {
+		seq := int64(0)
+		if err = client.Call(myrpc.MessageServiceSavePrivate, args, &seq); err != nil {
 			c.mutex.Unlock()
-			log.Error("%s(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSavePrivate, key, args, err)
+			log.Error("%s(\"%s\", \"%v\", &seq) error(%v)", myrpc.MessageServiceSavePrivate, key, args, err)
 			return
 		}
+		m.Seq = seq
+		m.Stored = true
 	}
 	// push message
 	if err = c.writeMsg(key, m); err != nil {
@@ -161,22 +181,35 @@ func (c *SeqChannel) PushMsg(key string, m *myrpc.Message, expire uint) (err err
 // AddConn implements the Channel AddConn method.
 func (c *SeqChannel) AddConn(key string, conn *Connection) (*hlist.Element, error) {
 	c.mutex.Lock()
-	if c.conn.Len()+1 > Conf.MaxSubscriberPerChannel {
+	if c.expired {
+		c.mutex.Unlock()
+		log.Error("user_key:\"%s\" channel expired", key)
+		return nil, ErrChannelExpired
+	}
+	if c.conn.Len()+1 > Conf().MaxSubscriberPerChannel {
 		c.mutex.Unlock()
 		log.Error("user_key:\"%s\" exceed conn", key)
 		return nil, ErrMaxConn
 	}
 	// send first heartbeat to tell client service is ready for accept heartbeat
-	if _, err := conn.Conn.Write(HeartbeatReply); err != nil {
+	if _, err := conn.Conn.Write(conn.heartbeatReply()); err != nil {
 		c.mutex.Unlock()
 		log.Error("user_key:\"%s\" write first heartbeat to client error(%v)", key, err)
 		return nil, err
 	}
 	// add conn
-	conn.Buf = make(chan []byte, Conf.MsgBufNum)
+	conn.Buf = make(chan []byte, Conf().MsgBufNum)
+	conn.ackMutex = &sync.Mutex{}
+	conn.unacked = map[int64]*unackedMsg{}
 	conn.HandleWrite(key)
+	conn.replaying = conn.Replay
 	e := c.conn.PushFront(conn)
+	// emit under the lock, keep the events of the key in order
+	presence(myrpc.PresenceOnline, key, conn, c.conn.Len() == 1)
 	c.mutex.Unlock()
+	if conn.Replay {
+		go c.replay(key, conn)
+	}
 	ConnStat.IncrAdd()
 	log.Info("user_key:\"%s\" add conn = %d", key, c.conn.Len())
 	return e, nil
@@ -186,17 +219,145 @@ func (c *SeqChannel) AddConn(key string, conn *Connection) (*hlist.Element, erro
 func (c *SeqChannel) RemoveConn(key string, e *hlist.Element) error {
 	c.mutex.Lock()
 	tmp := c.conn.Remove(e)
-	c.mutex.Unlock()
 	conn, ok := tmp.(*Connection)
 	if !ok {
+		c.mutex.Unlock()
 		return ErrAssectionConn
 	}
+	// stop the replay
+	conn.replaying = false
+	conn.held = nil
+	presence(myrpc.PresenceOffline, key, conn, c.conn.Len() == 0)
+	c.last = time.Now()
+	c.mutex.Unlock()
+	// leave topics before close buf, avoid topic publish write a closed chan
+	UserTopic.LeaveAll(conn)
+	conn.CloseAck()
 	close(conn.Buf)
 	ConnStat.IncrRemove()
 	log.Info("user_key:\"%s\" remove conn = %d", key, c.conn.Len())
 	return nil
 }
 
+// Redirect implements the Channel Redirect method.
+func (c *SeqChannel) Redirect(key string, addr *myrpc.CometNodeAddr) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		conn, ok := e.Value.(*Connection)
+		if !ok {
+			return ErrAssectionConn
+		}
+		// redirect frame: "-r addr\r\n", nil addr means "-r\r\n"
+		reply := conn.redirectReply("")
+		if addr != nil {
+			addrs := addr.TcpAddr
+			if conn.Proto == WebsocketProto {
+				addrs = addr.WsAddr
+			} else if conn.Proto == BinaryProto {
+				addrs = addr.Tcp2Addr
+			} else if conn.Proto == SSEProto {
+				addrs = addr.SseAddr
+			} else if conn.Proto == LongPollProto {
+				addrs = addr.LongPollAddr
+			}
+			// keep the secure connection secure
+			if conn.TLS {
+				addrs = addr.TlsAddr
+				if conn.Proto == WebsocketProto {
+					addrs = addr.WssAddr
+				}
+			}
+			if len(addrs) == 0 {
+				continue
+			}
+			reply = conn.redirectReply(addrs[rand.Intn(len(addrs))])
+		}
+		if _, err := conn.Conn.Write(reply); err != nil {
+			// ignore write error, the connection will be closed
+			log.Warn("user_key:\"%s\" write redirect to client error(%v)", key, err)
+		}
+	}
+	return nil
+}
+
+// Kick implements the Channel Kick method.
+func (c *SeqChannel) Kick(key, reason string, revoke bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if revoke && c.token != nil {
+		c.token = NewToken()
+	}
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		conn, ok := e.Value.(*Connection)
+		if !ok {
+			return ErrAssectionConn
+		}
+		if _, err := conn.Conn.Write(conn.kickReply(reason)); err != nil {
+			// ignore write error, the connection will be closed
+			log.Warn("user_key:\"%s\" write kick to client error(%v)", key, err)
+		}
+		// the connection removed by the reading goroutine
+		if err := conn.Conn.Close(); err != nil {
+			log.Warn("user_key:\"%s\" conn.Close() error(%v)", key, err)
+		}
+	}
+	log.Info("user_key:\"%s\" kick %d conns, reason:\"%s\", revoke:%t", key, c.conn.Len(), reason, revoke)
+	return nil
+}
+
+// Online implements the Channel Online method.
+func (c *SeqChannel) Online() *myrpc.CometOnline {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	o := &myrpc.CometOnline{Conn: c.conn.Len(), Proto: map[string]int{}}
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok {
+			o.Proto[protoNames[conn.Proto]]++
+		}
+	}
+	return o
+}
+
+// ExpireIdle implements the Channel ExpireIdle method.
+func (c *SeqChannel) ExpireIdle(ttl time.Duration) (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if c.conn.Len() > 0 || (c.token != nil && c.token.Valid()) {
+		return now.Add(ttl), false
+	}
+	if deadline := c.last.Add(ttl); deadline.After(now) {
+		return deadline, false
+	}
+	c.expired = true
+	return now, true
+}
+
+// Flushed implements the Channel Flushed method.
+func (c *SeqChannel) Flushed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok && len(conn.Buf) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Unacked implements the Channel Unacked method.
+func (c *SeqChannel) Unacked(mid int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.conn.Front(); e != nil; e = e.Next() {
+		if conn, ok := e.Value.(*Connection); ok && conn.Unacked(mid) {
+			return true
+		}
+	}
+	return false
+}
+
 // Close implements the Channel Close method.
 func (c *SeqChannel) Close() error {
 	c.mutex.Lock()
@@ -30,18 +30,26 @@ func InitSignal() chan os.Signal {
 	return c
 }
 
-// HandleSignal fetch signal from chan then do exit or reload.
+// HandleSignal fetch signal from chan then do exit or reload, also return
+// when a drain requested by admin rpc.
 func HandleSignal(c chan os.Signal) {
 	// Block until a signal is received.
 	for {
-		s := <-c
+		var s os.Signal
+		select {
+		case s = <-c:
+		case <-drainCH:
+			log.Info("comet get a drain request")
+			return
+		}
 		log.Info("comet get a signal %s", s.String())
 		switch s {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			// reload config
+			res := ReloadConfig()
+			log.Info("comet reload config succeed:%t applied:%v restart:%v", res.Succeed, res.Applied, res.Restart)
 		default:
 			return
 		}
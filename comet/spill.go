@@ -0,0 +1,69 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"errors"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"sync/atomic"
+)
+
+const (
+	// slow consumer policies, used when the connection buf is full
+	SlowPolicyDisconnect = "disconnect"
+	SlowPolicyDropOldest = "drop-oldest"
+	SlowPolicyDropNewest = "drop-newest"
+	SlowPolicySpill      = "spill"
+)
+
+var (
+	ErrSlowPolicy = errors.New("unknown slow consumer policy")
+)
+
+// validSlowPolicy check the slow consumer policy.
+func validSlowPolicy(policy string) bool {
+	switch policy {
+	case SlowPolicyDisconnect, SlowPolicyDropOldest, SlowPolicyDropNewest, SlowPolicySpill:
+		return true
+	}
+	return false
+}
+
+// spill leave the stored private message in the offline storage, the client
+// can get it by the offline message api. The later private messages of the
+// connection are left in the storage too, so the client gets them all in the
+// mid order by the last received mid. The other messages (group, topic and
+// not stored private messages) are never persisted by comet, so they're
+// dropped.
+func (c *Connection) spill(key string, m *myrpc.Message) {
+	if m.GroupId != myrpc.PrivateGroupId || !m.Stored {
+		MsgStat.IncrDroppedNewest(1)
+		log.Warn("user_key: \"%s\" slow consumer, drop not stored mid:%d", key, m.MsgId)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.spilled, 0, 1) {
+		log.Warn("user_key: \"%s\" slow consumer, stop pushing private messages from mid:%d", key, m.MsgId)
+	}
+	MsgStat.IncrDeferred(1)
+}
+
+// Spilled check the private messages of the connection are left in the
+// offline storage.
+func (c *Connection) Spilled() bool {
+	return atomic.LoadInt32(&c.spilled) == 1
+}
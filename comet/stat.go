@@ -43,6 +43,7 @@ type ChannelStat struct {
 	Access uint64 // total access count
 	Create uint64 // total create count
 	Delete uint64 // total delete count
+	Evict  uint64 // total idle channel evicted count
 }
 
 func (s *ChannelStat) IncrAccess() {
@@ -57,20 +58,39 @@ func (s *ChannelStat) IncrDelete() {
 	atomic.AddUint64(&s.Delete, 1)
 }
 
+func (s *ChannelStat) IncrEvict(delta uint64) {
+	atomic.AddUint64(&s.Evict, delta)
+}
+
 // Stat get the channle stat info
 func (s *ChannelStat) Stat() []byte {
 	res := map[string]interface{}{}
 	res["access"] = s.Access
 	res["create"] = s.Create
 	res["delete"] = s.Delete
+	res["evict"] = s.Evict
 	res["current"] = UserChannel.Count()
 	return jsonRes(res)
 }
 
 // Message stat info
 type MessageStat struct {
-	Succeed uint64 // total push message succeed count
-	Failed  uint64 // total push message failed count
+	Succeed     uint64 // total push message succeed count
+	Failed      uint64 // total push message failed count
+	Delivered   uint64 // total private message acked by client count
+	Redelivered uint64 // total private message redelivered count
+	Unacked     uint64 // total private message discarded without ack count
+	// slow consumer, the connection buf is full
+	Disconnected  uint64 // total message discarded with the connection closed count
+	DroppedOldest uint64 // total oldest buffered message dropped count
+	DroppedNewest uint64 // total newest message dropped count
+	Deferred      uint64 // total stored private message left in the offline storage count
+	// offline replay on subscribe
+	Replayed     uint64 // total stored private message replayed count
+	ReplayFailed uint64 // total replay failed count
+	// compression
+	CompressIn  uint64 // total bytes before compressed
+	CompressOut uint64 // total bytes after compressed
 }
 
 func (s *MessageStat) IncrSucceed(delta uint64) {
@@ -81,12 +101,65 @@ func (s *MessageStat) IncrFailed(delta uint64) {
 	atomic.AddUint64(&s.Failed, delta)
 }
 
+func (s *MessageStat) IncrDelivered(delta uint64) {
+	atomic.AddUint64(&s.Delivered, delta)
+}
+
+func (s *MessageStat) IncrRedelivered(delta uint64) {
+	atomic.AddUint64(&s.Redelivered, delta)
+}
+
+func (s *MessageStat) IncrUnacked(delta uint64) {
+	atomic.AddUint64(&s.Unacked, delta)
+}
+
+func (s *MessageStat) IncrDisconnected(delta uint64) {
+	atomic.AddUint64(&s.Disconnected, delta)
+}
+
+func (s *MessageStat) IncrDroppedOldest(delta uint64) {
+	atomic.AddUint64(&s.DroppedOldest, delta)
+}
+
+func (s *MessageStat) IncrDroppedNewest(delta uint64) {
+	atomic.AddUint64(&s.DroppedNewest, delta)
+}
+
+func (s *MessageStat) IncrDeferred(delta uint64) {
+	atomic.AddUint64(&s.Deferred, delta)
+}
+
+func (s *MessageStat) IncrReplayed(delta uint64) {
+	atomic.AddUint64(&s.Replayed, delta)
+}
+
+func (s *MessageStat) IncrReplayFailed(delta uint64) {
+	atomic.AddUint64(&s.ReplayFailed, delta)
+}
+
+func (s *MessageStat) IncrCompressed(in, out uint64) {
+	atomic.AddUint64(&s.CompressIn, in)
+	atomic.AddUint64(&s.CompressOut, out)
+}
+
 // Stat get the message stat info
 func (s *MessageStat) Stat() []byte {
 	res := map[string]interface{}{}
 	res["succeed"] = s.Succeed
 	res["failed"] = s.Failed
 	res["total"] = s.Succeed + s.Failed
+	res["delivered"] = s.Delivered
+	res["redelivered"] = s.Redelivered
+	res["unacked"] = s.Unacked
+	res["disconnected"] = s.Disconnected
+	res["dropped_oldest"] = s.DroppedOldest
+	res["dropped_newest"] = s.DroppedNewest
+	res["deferred"] = s.Deferred
+	res["replayed"] = s.Replayed
+	res["replay_failed"] = s.ReplayFailed
+	res["compress_in"] = s.CompressIn
+	res["compress_out"] = s.CompressOut
+	res["compress_saved"] = int64(s.CompressIn) - int64(s.CompressOut)
 	return jsonRes(res)
 }
 
@@ -94,6 +167,9 @@ func (s *MessageStat) Stat() []byte {
 type ConnectionStat struct {
 	Add    uint64 // total add connection count
 	Remove uint64 // total remove connection count
+	// presence events
+	PresenceSent    uint64 // total presence event sent count
+	PresenceDropped uint64 // total presence event dropped count
 }
 
 func (s *ConnectionStat) IncrAdd() {
@@ -104,12 +180,22 @@ func (s *ConnectionStat) IncrRemove() {
 	atomic.AddUint64(&s.Remove, 1)
 }
 
+func (s *ConnectionStat) IncrPresenceSent(delta uint64) {
+	atomic.AddUint64(&s.PresenceSent, delta)
+}
+
+func (s *ConnectionStat) IncrPresenceDropped(delta uint64) {
+	atomic.AddUint64(&s.PresenceDropped, delta)
+}
+
 // Stat get the connection stat info
 func (s *ConnectionStat) Stat() []byte {
 	res := map[string]interface{}{}
 	res["add"] = s.Add
 	res["remove"] = s.Remove
 	res["current"] = s.Add - s.Remove
+	res["presence_sent"] = s.PresenceSent
+	res["presence_dropped"] = s.PresenceDropped
 	return jsonRes(res)
 }
 
@@ -125,7 +211,7 @@ func statListen(bind string) {
 // start stats, called at process start
 func StartStats() {
 	startTime = time.Now().UnixNano()
-	for _, bind := range Conf.StatBind {
+	for _, bind := range Conf().StatBind {
 		log.Info("start stat listen addr:\"%s\"", bind)
 		go statListen(bind)
 	}
@@ -208,9 +294,19 @@ func ServerStats() []byte {
 
 // configuration info
 func ConfigInfo() []byte {
-	byteJson, err := json.MarshalIndent(Conf, "", "    ")
+	byteJson, err := json.MarshalIndent(Conf(), "", "    ")
+	if err != nil {
+		log.Error("json.MarshalIndent(\"%v\", \"\", \"    \") error(%v)", Conf(), err)
+		return nil
+	}
+	return byteJson
+}
+
+// reload info, the last config reload result
+func ReloadInfo() []byte {
+	byteJson, err := json.MarshalIndent(liveConf.Last(), "", "    ")
 	if err != nil {
-		log.Error("json.MarshalIndent(\"%v\", \"\", \"    \") error(%v)", Conf, err)
+		log.Error("json.MarshalIndent(\"%v\", \"\", \"    \") error(%v)", liveConf.Last(), err)
 		return nil
 	}
 	return byteJson
@@ -269,6 +365,8 @@ func StatHandle(w http.ResponseWriter, r *http.Request) {
 		res = MsgStat.Stat()
 	case "connection":
 		res = ConnStat.Stat()
+	case "reload":
+		res = ReloadInfo()
 	default:
 		http.Error(w, "Not Found", 404)
 	}
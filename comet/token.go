@@ -20,9 +20,19 @@ import (
 	log "github.com/alecthomas/log4go"
 	"container/list"
 	"errors"
+	"github.com/Terry-Mao/gopush-cluster/auth"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"sync"
 	"time"
 )
 
+const (
+	// auth modes
+	AuthModeToken    = "token"    // tokens registered by "CometRPC.New"
+	AuthModeSigned   = "signed"   // stateless signed tokens verified locally
+	AuthModeExternal = "external" // tokens verified by a external verifier
+)
+
 var (
 	// Token exists
 	ErrTokenExist = errors.New("token exist")
@@ -30,6 +40,18 @@ var (
 	ErrTokenNotExist = errors.New("token not exist")
 	// Token expired
 	ErrTokenExpired = errors.New("token expired")
+	// Signed token key not match
+	ErrTokenKey = errors.New("signed token key not match")
+	// Signed token has no subscribe scope
+	ErrTokenScope = errors.New("signed token scope not allowed")
+	// Signed token issued before the revocation
+	ErrTokenRevoked = errors.New("signed token revoked")
+	// Unknown auth mode
+	ErrAuthMode = errors.New("unknown auth mode")
+	// the known signed token revocations, key -> revoke unix time, the
+	// revocations are saved by the message service
+	signedRevoked      = map[string]int64{}
+	signedRevokedMutex = &sync.Mutex{}
 )
 
 // Token struct
@@ -56,7 +78,7 @@ func NewToken() *Token {
 func (t *Token) Add(ticket string) error {
 	if e, ok := t.token[ticket]; !ok {
 		// new element add to lru back
-		e = t.lru.PushBack(&TokenData{Ticket: ticket, Expire: time.Now().Add(Conf.TokenExpire)})
+		e = t.lru.PushBack(&TokenData{Ticket: ticket, Expire: time.Now().Add(Conf().TokenExpire)})
 		t.token[ticket] = e
 	} else {
 		log.Warn("token \"%s\" exist", ticket)
@@ -78,13 +100,19 @@ func (t *Token) Auth(ticket string) error {
 			log.Warn("token \"%s\" expired", ticket)
 			return ErrTokenExpired
 		}
-		td.Expire = time.Now().Add(Conf.TokenExpire)
+		td.Expire = time.Now().Add(Conf().TokenExpire)
 		t.lru.MoveToBack(e)
 	}
 	t.clean()
 	return nil
 }
 
+// Valid check any token not expired.
+func (t *Token) Valid() bool {
+	t.clean()
+	return t.lru.Len() > 0
+}
+
 // clean scan the lru list expire the element
 func (t *Token) clean() {
 	now := time.Now()
@@ -105,3 +133,110 @@ func (t *Token) clean() {
 		break
 	}
 }
+
+// validAuthMode check the auth mode.
+func validAuthMode(mode string) bool {
+	return mode == AuthModeToken || mode == AuthModeSigned || mode == AuthModeExternal
+}
+
+// authStateless verify the token by the signed or external auth mode, no
+// channel state is needed, return the connection attributes.
+func authStateless(key, token string) (map[string]string, error) {
+	if Conf().AuthMode == AuthModeSigned {
+		return nil, authSigned(key, token)
+	}
+	return authExternal(key, token)
+}
+
+// authSigned verify the signed token of the key by the configured secrets,
+// no state is needed, so it's verified before the channel is created.
+func authSigned(key, ticket string) error {
+	c, err := auth.Verify(Conf().AuthSecrets, ticket)
+	if err != nil {
+		return err
+	}
+	if c.Key != key {
+		return ErrTokenKey
+	}
+	if !c.HasScope(auth.ScopeSub) {
+		return ErrTokenScope
+	}
+	t, err := signedRevokedAt(key)
+	if err != nil {
+		return err
+	}
+	// "iat" is in seconds, the tokens issued in the second of the revocation
+	// are kept, so a token re-issued right after the kick is valid
+	if t > 0 && c.Issued < t {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// revokeSigned reject the signed tokens of the key issued before now, the
+// tokens without "iat" are rejected too. The revocation is saved by the
+// message service, so it survives the restart of comet and the key migration
+// between comet nodes. A revocation lasts Conf().TokenExpire, the backend
+// should sign the tokens expire in it.
+func revokeSigned(key string) error {
+	now := time.Now().Unix()
+	setSignedRevoked(key, now)
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		return ErrMessageRPC
+	}
+	args := &myrpc.MessageSaveRevokeArgs{Key: key, Time: now, Expire: uint(Conf().TokenExpire / time.Second)}
+	ret := 0
+	if err := client.Call(myrpc.MessageServiceSaveRevoke, args, &ret); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSaveRevoke, args, err)
+		return err
+	}
+	return nil
+}
+
+// setSignedRevoked keep a known revocation of the key, the expired ones are
+// cleaned.
+func setSignedRevoked(key string, t int64) {
+	now := time.Now().Unix()
+	signedRevokedMutex.Lock()
+	defer signedRevokedMutex.Unlock()
+	for k, rt := range signedRevoked {
+		if signedRevokeExpired(rt, now) {
+			delete(signedRevoked, k)
+		}
+	}
+	if t > signedRevoked[key] {
+		signedRevoked[key] = t
+	}
+}
+
+// signedRevokedAt get the revoke unix time of the key, 0 means not revoked.
+// The revocation unknown by this node (eg: revoked before the restart or on
+// the node owned the key before) is got from the message service.
+func signedRevokedAt(key string) (int64, error) {
+	signedRevokedMutex.Lock()
+	t, ok := signedRevoked[key]
+	signedRevokedMutex.Unlock()
+	if ok && !signedRevokeExpired(t, time.Now().Unix()) {
+		return t, nil
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		return 0, ErrMessageRPC
+	}
+	if err := client.Call(myrpc.MessageServiceGetRevoke, key, &t); err != nil {
+		log.Error("client.Call(\"%s\", \"%s\", &t) error(%v)", myrpc.MessageServiceGetRevoke, key, err)
+		return 0, err
+	}
+	if t > 0 {
+		setSignedRevoked(key, t)
+	}
+	return t, nil
+}
+
+// signedRevokeExpired check the revocation expired, 0 token expire means
+// never.
+func signedRevokeExpired(t, now int64) bool {
+	expire := int64(Conf().TokenExpire / time.Second)
+	return expire > 0 && now-t > expire
+}
@@ -0,0 +1,189 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"errors"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrTopic        = errors.New("Topic format error")
+	ErrMaxTopic     = errors.New("Exceed the max topic per connection")
+	ErrTopicNotJoin = errors.New("Topic not joined")
+	UserTopic       *TopicList
+)
+
+// Topic list, stored the ephemeral topic subscriptions of connections.
+// A topic is split by ".", the "*" segment of a pattern matches any one
+// segment, eg: "score.*" matches "score.nba" but not "score.nba.final".
+type TopicList struct {
+	mutex *sync.RWMutex
+	// topic -> connections -> subscriber key
+	exact map[string]map[*Connection]string
+	// pattern -> connections -> subscriber key
+	wildcard map[string]map[*Connection]string
+}
+
+// NewTopicList create a new topic list.
+func NewTopicList() *TopicList {
+	return &TopicList{
+		mutex:    &sync.RWMutex{},
+		exact:    map[string]map[*Connection]string{},
+		wildcard: map[string]map[*Connection]string{},
+	}
+}
+
+// validateTopic check the topic or pattern format.
+func validateTopic(topic string, pattern bool) error {
+	if !myrpc.ValidTopic(topic, pattern) {
+		return ErrTopic
+	}
+	return nil
+}
+
+// matchTopic check the topic matches the pattern.
+func matchTopic(pattern, topic string) bool {
+	ps := strings.Split(pattern, myrpc.TopicSpliter)
+	ts := strings.Split(topic, myrpc.TopicSpliter)
+	if len(ps) != len(ts) {
+		return false
+	}
+	for i, p := range ps {
+		if p != myrpc.TopicWildcard && p != ts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// subs get the subscriptions map of the topic.
+func (l *TopicList) subs(topic string) map[string]map[*Connection]string {
+	if strings.Contains(topic, myrpc.TopicWildcard) {
+		return l.wildcard
+	}
+	return l.exact
+}
+
+// Join add the connection to the topic or pattern.
+func (l *TopicList) Join(key, topic string, conn *Connection) error {
+	if err := validateTopic(topic, true); err != nil {
+		log.Warn("user_key:\"%s\" join topic:\"%s\" error(%v)", key, topic, err)
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := conn.Topics[topic]; ok {
+		return nil
+	}
+	if len(conn.Topics) >= Conf().MaxTopicPerConn {
+		log.Warn("user_key:\"%s\" join topic:\"%s\" exceed max topic:%d", key, topic, Conf().MaxTopicPerConn)
+		return ErrMaxTopic
+	}
+	subs := l.subs(topic)
+	conns, ok := subs[topic]
+	if !ok {
+		conns = map[*Connection]string{}
+		subs[topic] = conns
+	}
+	conns[conn] = key
+	if conn.Topics == nil {
+		conn.Topics = map[string]bool{}
+	}
+	conn.Topics[topic] = true
+	log.Debug("user_key:\"%s\" join topic:\"%s\"", key, topic)
+	return nil
+}
+
+// Leave remove the connection from the topic or pattern.
+func (l *TopicList) Leave(key, topic string, conn *Connection) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := conn.Topics[topic]; !ok {
+		return ErrTopicNotJoin
+	}
+	l.leave(topic, conn)
+	log.Debug("user_key:\"%s\" leave topic:\"%s\"", key, topic)
+	return nil
+}
+
+// LeaveAll remove the connection from all the joined topics, must called
+// before the connection closed.
+func (l *TopicList) LeaveAll(conn *Connection) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for topic, _ := range conn.Topics {
+		l.leave(topic, conn)
+	}
+}
+
+// leave remove the connection from the topic without lock.
+func (l *TopicList) leave(topic string, conn *Connection) {
+	subs := l.subs(topic)
+	if conns, ok := subs[topic]; ok {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(subs, topic)
+		}
+	}
+	delete(conn.Topics, topic)
+}
+
+// Publish write the message to all the connections which joined the topic or
+// matched pattern, return the number of written connections.
+func (l *TopicList) Publish(topic string, m *myrpc.Message) (n int, err error) {
+	var (
+		msg []byte
+		enc = newMsgEncoder(m)
+	)
+	if err = validateTopic(topic, false); err != nil {
+		return
+	}
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	// merge the subscriptions, a connection only get the message once
+	conns := map[*Connection]string{}
+	for conn, key := range l.exact[topic] {
+		conns[conn] = key
+	}
+	for pattern, pconns := range l.wildcard {
+		if !matchTopic(pattern, topic) {
+			continue
+		}
+		for conn, key := range pconns {
+			conns[conn] = key
+		}
+	}
+	for conn, key := range conns {
+		if msg, err = enc.Bytes(conn); err != nil {
+			return
+		}
+		conn.Write(key, m, msg)
+		n++
+	}
+	return
+}
+
+// Count get the number of topics and patterns.
+func (l *TopicList) Count() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.exact) + len(l.wildcard)
+}
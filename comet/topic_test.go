@@ -0,0 +1,75 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTopic(t *testing.T) {
+	long := strings.Repeat("a", 129)
+	tests := []struct {
+		topic   string
+		pattern bool
+		err     error
+	}{
+		{"score", false, nil},
+		{"score.nba.final", false, nil},
+		{long[:128], false, nil},
+		{"", false, ErrTopic},
+		{long, false, ErrTopic},
+		{".score", false, ErrTopic},
+		{"score.", false, ErrTopic},
+		{"score..nba", false, ErrTopic},
+		{"score.*", false, ErrTopic},
+		{"score.*", true, nil},
+		{"*.nba.*", true, nil},
+		{"*", true, nil},
+		{"score.nba*", true, ErrTopic},
+		{"score.**", true, ErrTopic},
+		{"score..*", true, ErrTopic},
+	}
+	for _, test := range tests {
+		if err := validateTopic(test.topic, test.pattern); err != test.err {
+			t.Errorf("validateTopic(\"%s\", %t) error(%v), expect %v", test.topic, test.pattern, err, test.err)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"score.nba", "score.nba", true},
+		{"score.nba", "score.cba", false},
+		{"score.*", "score.nba", true},
+		{"score.*", "score", false},
+		{"score.*", "score.nba.final", false},
+		{"*.nba", "score.nba", true},
+		{"*.*", "score.nba", true},
+		{"*", "score", true},
+		{"*", "score.nba", false},
+	}
+	for _, test := range tests {
+		if match := matchTopic(test.pattern, test.topic); match != test.match {
+			t.Errorf("matchTopic(\"%s\", \"%s\") = %t, expect %t", test.pattern, test.topic, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"errors"
+	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"net/rpc"
+	"time"
+)
+
+var (
+	ErrUpstreamRPC     = errors.New("Upstream RPC not init")
+	ErrUpstreamTimeout = errors.New("upstream timeout")
+)
+
+// InitUpstream init the upstream sink rpc, the client commands will be
+// forwarded to it, the unreachable sink is reconnected in background.
+func InitUpstream() {
+	if len(Conf().UpstreamAddr) == 0 {
+		log.Warn("no upstream sink addr, client commands will be rejected")
+		return
+	}
+	myrpc.InitUpstream(Conf().UpstreamAddr, Conf().RPCRetry, Conf().RPCPing)
+}
+
+// upstream forward the client command to the upstream sink, it's called by
+// the reader routine of the connection, so the call is bounded by
+// Conf().UpstreamTimeout.
+func upstream(args *myrpc.UpstreamArgs) error {
+	client := myrpc.UpstreamRPC.Get()
+	if client == nil {
+		log.Error("user_key:\"%s\" cmd:\"%s\" no upstream sink found", args.Key, args.Cmd)
+		return ErrUpstreamRPC
+	}
+	args.Node = Conf().ZookeeperCometNode
+	ret := 0
+	timer := time.NewTimer(Conf().UpstreamTimeout)
+	defer timer.Stop()
+	call := client.Go(myrpc.UpstreamServiceReceive, args, &ret, make(chan *rpc.Call, 1))
+	select {
+	case call = <-call.Done:
+		if call.Error != nil {
+			log.Error("client.Go(\"%s\", \"%v\", &ret) error(%v)", myrpc.UpstreamServiceReceive, args, call.Error)
+			return call.Error
+		}
+	case <-timer.C:
+		log.Error("client.Go(\"%s\", \"%v\", &ret) error(%v)", myrpc.UpstreamServiceReceive, args, ErrUpstreamTimeout)
+		return ErrUpstreamTimeout
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// the websocket permessage-deflate extension (RFC 7692), the compression
+	// contexts are not taken over, every message is deflated alone
+	wsExtDeflate         = "permessage-deflate"
+	wsExtDeflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+	// max payload of a received websocket message, compressed or inflated
+	wsMaxMessage = 64 * 1024
+	// websocket frame bits
+	wsFlagFin  = byte(0x80)
+	wsFlagRsv1 = byte(0x40)
+)
+
+var (
+	ErrWSOrigin   = errors.New("websocket null origin")
+	ErrWSTooLarge = errors.New("websocket message too large")
+	ErrWSRawConn  = errors.New("websocket raw connection not found")
+	// the tail stripped by the sender, and an empty final stored block, so
+	// the inflater ends with io.EOF
+	wsDeflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+	// the context key of the raw connection of a websocket request
+	wsRawConnKey = &struct{ name string }{"ws-raw-conn"}
+)
+
+// wsConnContext keep the raw connection in the request context, the
+// permessage-deflate frames are written on it.
+func wsConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, wsRawConnKey, c)
+}
+
+// wsHandshake check the origin as websocket.Handler does, then accept the
+// permessage-deflate offer if the compression enabled.
+func wsHandshake(config *websocket.Config, req *http.Request) (err error) {
+	if config.Origin, err = websocket.Origin(config, req); err == nil && config.Origin == nil {
+		return ErrWSOrigin
+	}
+	if err != nil {
+		return
+	}
+	if Conf().Compress && wsOfferDeflate(req.Header.Get("Sec-WebSocket-Extensions")) {
+		config.Header = http.Header{"Sec-Websocket-Extensions": {wsExtDeflateResponse}}
+	}
+	return
+}
+
+// wsOfferDeflate check the client offers an acceptable permessage-deflate,
+// eg: "permessage-deflate; client_max_window_bits". The offer limits the
+// server window can't be accepted, the flate writer always uses 32K.
+func wsOfferDeflate(exts string) bool {
+	for _, ext := range strings.Split(exts, ",") {
+		params := strings.Split(ext, ";")
+		if strings.TrimSpace(params[0]) != wsExtDeflate {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if kv[0] == "server_max_window_bits" && (len(kv) != 2 || strings.Trim(kv[1], "\"") != "15") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wsDeflated check the permessage-deflate negotiated by the handshake.
+func wsDeflated(ws *websocket.Conn) bool {
+	return ws.Config().Header.Get("Sec-Websocket-Extensions") != ""
+}
+
+// wsDeflateConn is a websocket connection negotiated the permessage-deflate.
+// x/net/websocket can't set the RSV1 bit, so the frames are written on the
+// raw connection by one Write call, which never interleaves with the pong and
+// close frames written by x/net/websocket. The frames are read by the
+// x/net/websocket frame reader.
+type wsDeflateConn struct {
+	*websocket.Conn
+	raw net.Conn
+}
+
+// newWSDeflateConn get the raw connection of the websocket.
+func newWSDeflateConn(ws *websocket.Conn) (*wsDeflateConn, error) {
+	raw, ok := ws.Request().Context().Value(wsRawConnKey).(net.Conn)
+	if !ok {
+		return nil, ErrWSRawConn
+	}
+	return &wsDeflateConn{Conn: ws, raw: raw}, nil
+}
+
+// Write write a uncompressed text frame.
+func (c *wsDeflateConn) Write(msg []byte) (int, error) {
+	return c.writeFrame(msg, false)
+}
+
+// WriteDeflate write a text frame of the deflated message.
+func (c *wsDeflateConn) WriteDeflate(msg []byte) (int, error) {
+	return c.writeFrame(msg, true)
+}
+
+// writeFrame write a unmasked text frame.
+func (c *wsDeflateConn) writeFrame(msg []byte, compressed bool) (int, error) {
+	b := wsFlagFin | websocket.TextFrame
+	if compressed {
+		b |= wsFlagRsv1
+	}
+	frame := make([]byte, 0, len(msg)+10)
+	frame = append(frame, b)
+	switch l := len(msg); {
+	case l <= 125:
+		frame = append(frame, byte(l))
+	case l < 65536:
+		frame = append(frame, 126, byte(l>>8), byte(l))
+	default:
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(l))
+		frame = append(append(frame, 127), n[:]...)
+	}
+	frame = append(frame, msg...)
+	if _, err := c.raw.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// ReadMessage read a text or binary frame, the control frames are handled by
+// x/net/websocket, the compressed message (RSV1 set) is inflated.
+func (c *wsDeflateConn) ReadMessage() (string, error) {
+	for {
+		frame, err := c.NewFrameReader()
+		if err != nil {
+			return "", err
+		}
+		// the first header byte: FIN, RSV1-3, opcode
+		compressed := false
+		if h := frame.HeaderReader(); h != nil {
+			b := make([]byte, 1)
+			if _, err = h.Read(b); err != nil {
+				return "", err
+			}
+			compressed = b[0]&wsFlagRsv1 != 0
+		}
+		if frame, err = c.HandleFrame(frame); err != nil {
+			return "", err
+		}
+		// control frame
+		if frame == nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(frame, wsMaxMessage+1))
+		if err != nil {
+			return "", err
+		}
+		if len(data) > wsMaxMessage {
+			return "", ErrWSTooLarge
+		}
+		if compressed {
+			if data, err = wsInflate(data); err != nil {
+				return "", err
+			}
+		}
+		return string(data), nil
+	}
+}
+
+// wsInflate inflate a permessage-deflate compressed message.
+func wsInflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(wsDeflateTail)))
+	defer r.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(r, wsMaxMessage+1))
+	if err != nil {
+		log.Error("flate.Read() error(%v)", err)
+		return nil, err
+	}
+	if len(msg) > wsMaxMessage {
+		return nil, ErrWSTooLarge
+	}
+	return msg, nil
+}
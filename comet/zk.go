@@ -23,6 +23,7 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	"encoding/json"
+	"github.com/Terry-Mao/gopush-cluster/id"
 	"github.com/Terry-Mao/gopush-cluster/rpc"
 	myzk "github.com/Terry-Mao/gopush-cluster/zk"
 	"github.com/samuel/go-zookeeper/zk"
@@ -36,34 +37,105 @@ const (
 	waitNodeDelaySecond = waitNodeDelay * time.Second
 )
 
+var (
+	// the registered ephemeral node, used for updating node info
+	cometZKConn *zk.Conn
+	cometZKNode string
+)
+
 func InitZK() (*zk.Conn, error) {
-	conn, err := myzk.Connect(Conf.ZookeeperAddr, Conf.ZookeeperTimeout)
+	conn, err := myzk.Connect(Conf().ZookeeperAddr, Conf().ZookeeperTimeout)
 	if err != nil {
 		log.Error("myzk.Connect() error(%v)", err)
 		return nil, err
 	}
-	fpath := path.Join(Conf.ZookeeperCometPath, Conf.ZookeeperCometNode)
+	// claim the id node before the comet node is visible to web
+	if err = initID(conn); err != nil {
+		return conn, err
+	}
+	fpath := path.Join(Conf().ZookeeperCometPath, Conf().ZookeeperCometNode)
 	if err = myzk.Create(conn, fpath); err != nil {
 		log.Error("myzk.Create(conn,\"%s\",\"\") error(%v)", fpath, err)
 		return conn, err
 	}
-	// comet tcp, websocket and rpc bind address store in the zk
-	nodeInfo := &rpc.CometNodeInfo{}
-	nodeInfo.RpcAddr = Conf.RPCBind
-	nodeInfo.TcpAddr = Conf.TCPBind
-	nodeInfo.WsAddr = Conf.WebsocketBind
-	nodeInfo.Weight = Conf.ZookeeperCometWeight
-	data, err := json.Marshal(nodeInfo)
+	data, err := nodeData()
 	if err != nil {
-		log.Error("json.Marshal() error(%v)", err)
 		return conn, err
 	}
 	log.Debug("myzk node:\"%s\" registe data: \"%s\"", fpath, string(data))
-	if err = myzk.RegisterTemp(conn, fpath, data); err != nil {
-		log.Error("myzk.RegisterTemp() error(%v)", err)
+	if cometZKNode, err = myzk.RegisterTempNode(conn, fpath, data); err != nil {
+		log.Error("myzk.RegisterTempNode() error(%v)", err)
 		return conn, err
 	}
+	cometZKConn = conn
 	// watch and update
-	rpc.InitMessage(conn, Conf.ZookeeperMessagePath, Conf.RPCRetry, Conf.RPCPing)
+	rpc.InitMessage(conn, Conf().ZookeeperMessagePath, Conf().RPCRetry, Conf().RPCPing)
 	return conn, nil
 }
+
+// initID claim a node id from the zk for the message id generator.
+func initID(conn *zk.Conn) error {
+	node, err := myzk.RegisterTempId(conn, Conf().ZookeeperIdPath, []byte(Conf().ZookeeperCometNode), id.MaxNode)
+	if err != nil {
+		log.Error("myzk.RegisterTempId(\"%s\") error(%v)", Conf().ZookeeperIdPath, err)
+		return err
+	}
+	if err = id.Init(node); err != nil {
+		log.Error("id.Init(%d) error(%v)", node, err)
+		return err
+	}
+	log.Info("message id generator node: %d", node)
+	return nil
+}
+
+// nodeData get the comet node info stored in the zk.
+func nodeData() ([]byte, error) {
+	// comet tcp, websocket and rpc bind address store in the zk
+	nodeInfo := &rpc.CometNodeInfo{}
+	nodeInfo.RpcAddr = Conf().RPCBind
+	nodeInfo.TcpAddr = Conf().TCPBind
+	nodeInfo.WsAddr = Conf().WebsocketBind
+	nodeInfo.TlsAddr = Conf().TCPTLSBind
+	nodeInfo.Tcp2Addr = Conf().TCPV2Bind
+	nodeInfo.SseAddr = Conf().SSEBind
+	nodeInfo.LongPollAddr = Conf().LongPollBind
+	nodeInfo.WssAddr = Conf().WebsocketTLSBind
+	nodeInfo.Weight = Conf().ZookeeperCometWeight
+	data, err := json.Marshal(nodeInfo)
+	if err != nil {
+		log.Error("json.Marshal() error(%v)", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// unregisterZK delete the comet node from the zk, the id node is kept.
+func unregisterZK() {
+	if cometZKConn == nil || cometZKNode == "" {
+		return
+	}
+	if err := cometZKConn.Delete(cometZKNode, -1); err != nil {
+		log.Error("zk.Delete(\"%s\", -1) error(%v)", cometZKNode, err)
+		return
+	}
+	log.Info("zk node:\"%s\" deleted", cometZKNode)
+	cometZKNode = ""
+}
+
+// UpdateZK re-publish the comet node info to the zk, eg: weight changed.
+func UpdateZK() error {
+	if cometZKConn == nil || cometZKNode == "" {
+		log.Warn("comet not registered in zk, skip update")
+		return nil
+	}
+	data, err := nodeData()
+	if err != nil {
+		return err
+	}
+	if _, err = cometZKConn.Set(cometZKNode, data, -1); err != nil {
+		log.Error("zk.Set(\"%s\", \"%s\", -1) error(%v)", cometZKNode, string(data), err)
+		return err
+	}
+	log.Info("zk node:\"%s\" update data: \"%s\"", cometZKNode, string(data))
+	return nil
+}
@@ -17,38 +17,120 @@
 package id
 
 import (
+	"errors"
+	"sync"
 	"time"
 )
 
-/*
+// The id is a 52 bits snowflake stored in the range [2^55, 2^56):
+//
+// +---------+-----------------------+-------------+------------+---------+
+// | 2^55    | 40 bits milliseconds  | 6 bits node | 6 bits seq | 3 bits 0|
+// +---------+-----------------------+-------------+------------+---------+
+//
+// The 2^55 base keeps the ids above the legacy time.Now().UnixNano()/100 ids
+// (they reach 2^55 in 2084), so the clients and the stored messages need no
+// migration. A double is exact for the multiples of 8 in the range, so the
+// id is exact as the redis zset score and fits the mysql bigint. The
+// milliseconds since Epoch last till 2058, the node id is unique among the
+// running comet and web processes (assigned by zookeeper), the seq allows 64
+// ids per millisecond per node.
+const (
+	Epoch      = int64(1704067200000) // 2024-01-01 00:00:00 UTC in milliseconds
+	Base       = int64(1) << 55
+	TimeBits   = 40
+	NodeBits   = 6
+	SeqBits    = 6
+	MaxNode    = 1<<NodeBits - 1
+	MaxID      = Base | (1<<(TimeBits+NodeBits+SeqBits)-1)<<scoreShift
+	maxSeq     = 1<<SeqBits - 1
+	scoreShift = 3
+	nodeShift  = SeqBits
+	timeShift  = SeqBits + NodeBits
+)
+
+var (
+	ErrNode = errors.New("node id out of range")
+	// default id generator, used by Get
+	defaultID = NewTimeID()
+)
+
+// TimeID is a snowflake like id generator, the ids are strictly increasing.
+// When the clock steps backwards or the seq of a millisecond exhausted, the
+// last timestamp is borrowed and continued, so it never blocks or repeats,
+// the wall clock catches up later.
 type TimeID struct {
-	lastID int64
+	mutex *sync.Mutex
+	node  int64
+	last  int64 // last milliseconds since Epoch
+	seq   int64
 }
 
-// NewTimeID create a new TimeID struct
+// NewTimeID create a new TimeID struct of node 0.
 func NewTimeID() *TimeID {
-	return &TimeID{lastID: 0}
+	return &TimeID{mutex: &sync.Mutex{}}
+}
+
+// NewNodeTimeID create a new TimeID struct of the node.
+func NewNodeTimeID(node int) (*TimeID, error) {
+	t := NewTimeID()
+	if err := t.SetNode(node); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SetNode set the node id.
+func (t *TimeID) SetNode(node int) error {
+	if node < 0 || node > MaxNode {
+		return ErrNode
+	}
+	t.mutex.Lock()
+	t.node = int64(node)
+	t.mutex.Unlock()
+	return nil
 }
 
-// ID generate a time ID
+// ID generate a time ID.
 func (t *TimeID) ID() int64 {
-	for {
-		s := time.Now().UnixNano() / 100
-		if t.lastID >= s {
-			// if last time id > current time, may be who change the system id,
-			// so sleep last time id minus current time
-			panic("time delay!!!!!!")
-		} else {
-			// save the current time id
-			t.lastID = s
-			return s
-		}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now().UnixNano()/int64(time.Millisecond) - Epoch
+	if now > t.last {
+		t.last = now
+		t.seq = 0
+	} else if t.seq++; t.seq > maxSeq {
+		// clock moved backwards or seq exhausted, borrow the next millisecond
+		t.last++
+		t.seq = 0
 	}
-	return 0
+	return Base | (t.last<<timeShift|t.node<<nodeShift|t.seq)<<scoreShift
+}
+
+// Init set the node id of the default generator, must be called before Get.
+func Init(node int) error {
+	return defaultID.SetNode(node)
 }
-*/
 
 // Get get a time id.
 func Get() int64 {
-	return time.Now().UnixNano() / 100
+	return defaultID.ID()
+}
+
+// FromTime get the smallest id of the millisecond without consuming a seq,
+// all the ids generated after the millisecond are greater than it, eg: used
+// as the offline message cursor of the current time.
+func FromTime(t time.Time) int64 {
+	return Base | (t.UnixNano()/int64(time.Millisecond)-Epoch)<<timeShift<<scoreShift
+}
+
+// Time get the generated time of the id.
+func Time(id int64) time.Time {
+	ms := (id-Base)>>scoreShift>>timeShift + Epoch
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// Node get the node id of the id.
+func Node(id int64) int {
+	return int((id - Base) >> scoreShift >> nodeShift & MaxNode)
 }
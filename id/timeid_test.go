@@ -18,6 +18,7 @@ package id
 
 import (
 	"testing"
+	"time"
 )
 
 func TestTimeID(t *testing.T) {
@@ -28,3 +29,63 @@ func TestTimeID(t *testing.T) {
 		t.Error("time a > b")
 	}
 }
+
+func TestNodeTimeID(t *testing.T) {
+	if _, err := NewNodeTimeID(MaxNode + 1); err != ErrNode {
+		t.Errorf("NewNodeTimeID() error(%v)", err)
+	}
+	tid, err := NewNodeTimeID(5)
+	if err != nil {
+		t.Fatalf("NewNodeTimeID() error(%v)", err)
+	}
+	now := time.Now()
+	last := int64(0)
+	// more than the seq of a millisecond
+	for i := 0; i < 10000; i++ {
+		id := tid.ID()
+		if id <= last {
+			t.Fatalf("id %d <= last %d", id, last)
+		}
+		if id > MaxID {
+			t.Fatalf("id %d > max %d", id, MaxID)
+		}
+		if Node(id) != 5 {
+			t.Fatalf("id %d node %d", id, Node(id))
+		}
+		last = id
+	}
+	if d := Time(last).Sub(now); d < 0 || d > time.Second {
+		t.Errorf("id time %v, now %v", Time(last), now)
+	}
+}
+
+func TestTimeIDClockBackwards(t *testing.T) {
+	tid := NewTimeID()
+	a := tid.ID()
+	// the clock stepped back one minute
+	tid.last += int64(time.Minute / time.Millisecond)
+	b := tid.ID()
+	c := tid.ID()
+	if b <= a || c <= b {
+		t.Errorf("ids not increasing: %d %d %d", a, b, c)
+	}
+}
+
+func TestIDRange(t *testing.T) {
+	// the legacy UnixNano()/100 ids are smaller
+	legacy := time.Now().UnixNano() / 100
+	now := time.Now()
+	tid := NewTimeID()
+	a := FromTime(now)
+	b := tid.ID()
+	if a <= legacy || b < a {
+		t.Errorf("legacy %d, from time %d, id %d", legacy, a, b)
+	}
+	// exact as a double
+	if int64(float64(b)) != b {
+		t.Errorf("id %d not exact as a double", b)
+	}
+	if Time(a).UnixNano()/int64(time.Millisecond) != now.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("from time %v, id time %v", now, Time(a))
+	}
+}
@@ -17,16 +17,28 @@
 package main
 
 import (
+	log "github.com/alecthomas/log4go"
 	"flag"
 	"fmt"
 	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gopush-cluster/reload"
 	"runtime"
 	"time"
 )
 
 var (
-	Conf     *Config
+	// the current config, replaced when reloading
+	liveConf *reload.Config
 	confFile string
+	// the settings can be applied at runtime
+	hotConf = map[string]bool{
+		"Log":              true,
+		"RedisIdleTimeout": true,
+		"RedisMaxIdle":     true,
+		"RedisMaxActive":   true,
+		"RedisMaxStore":    true,
+		"MySQLClean":       true,
+	}
 )
 
 func init() {
@@ -43,6 +55,7 @@ type Config struct {
 	Log              string            `goconf:"base:log"`
 	MaxProc          int               `goconf:"base:maxproc"`
 	PprofBind        []string          `goconf:"base:pprof.bind:,"`
+	StatBind         []string          `goconf:"base:stat.bind:,"`
 	StorageType      string            `goconf:"storage:type"`
 	RedisIdleTimeout time.Duration     `goconf:"redis:timeout:time"`
 	RedisMaxIdle     int               `goconf:"redis:idle"`
@@ -57,13 +70,28 @@ type Config struct {
 	ZookeeperPath    string        `goconf:"zookeeper:path"`
 }
 
-// NewConfig parse config file into Config.
+// InitConfig parse config file into Conf().
 func InitConfig() error {
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	liveConf, err = reload.New(c, hotConf)
+	return err
+}
+
+// Conf get the current config, the config must not be modified.
+func Conf() *Config {
+	return liveConf.Get().(*Config)
+}
+
+// newConfig parse config file into a new Config.
+func newConfig() (*Config, error) {
 	gconf := goconf.New()
 	if err := gconf.Parse(confFile); err != nil {
-		return err
+		return nil, err
 	}
-	Conf = &Config{
+	conf := &Config{
 		// base
 		RPCBind:    []string{"localhost:8070"},
 		NodeWeight: 1,
@@ -73,6 +101,7 @@ func InitConfig() error {
 		Log:        "./log/xml",
 		MaxProc:    runtime.NumCPU(),
 		PprofBind:  []string{"localhost:8170"},
+		StatBind:   []string{"localhost:8172"},
 		// storage
 		StorageType: "redis",
 		// redis
@@ -89,8 +118,8 @@ func InitConfig() error {
 		ZookeeperTimeout: 30 * time.Second,
 		ZookeeperPath:    "/gopush-cluster-message",
 	}
-	if err := gconf.Unmarshal(Conf); err != nil {
-		return err
+	if err := gconf.Unmarshal(conf); err != nil {
+		return nil, err
 	}
 	// redis section
 	redisAddrsSec := gconf.Get("redis.source")
@@ -98,9 +127,9 @@ func InitConfig() error {
 		for _, key := range redisAddrsSec.Keys() {
 			addr, err := redisAddrsSec.String(key)
 			if err != nil {
-				return fmt.Errorf("config section: \"redis.addrs\" key: \"%s\" error(%v)", key, err)
+				return nil, fmt.Errorf("config section: \"redis.addrs\" key: \"%s\" error(%v)", key, err)
 			}
-			Conf.RedisSource[key] = addr
+			conf.RedisSource[key] = addr
 		}
 	}
 	// mysql section
@@ -109,10 +138,34 @@ func InitConfig() error {
 		for _, key := range dbSource.Keys() {
 			source, err := dbSource.String(key)
 			if err != nil {
-				return fmt.Errorf("config section: \"mysql.source\" key: \"%s\" error(%v)", key, err)
+				return nil, fmt.Errorf("config section: \"mysql.source\" key: \"%s\" error(%v)", key, err)
 			}
-			Conf.MySQLSource[key] = source
+			conf.MySQLSource[key] = source
 		}
 	}
-	return nil
+	return conf, nil
+}
+
+// ReloadConfig re-read the config file and apply the hot settings, the
+// changed settings which can't be applied at runtime are reported in the
+// result.
+func ReloadConfig() *reload.Stat {
+	return liveConf.Reload(func() (interface{}, error) {
+		return newConfig()
+	}, nil, func(c interface{}, applied []string) error {
+		resetPool := false
+		for _, name := range applied {
+			switch name {
+			case "Log":
+				log.LoadConfiguration(c.(*Config).Log)
+			case "RedisIdleTimeout", "RedisMaxIdle", "RedisMaxActive":
+				resetPool = true
+			}
+		}
+		// the redis pools are re-created with the new sizes
+		if s, ok := UseStorage.(*RedisStorage); ok && resetPool {
+			s.ResetPool()
+		}
+		return nil
+	})
 }
@@ -32,12 +32,14 @@ func main() {
 		panic(err)
 	}
 	// Set max routine
-	runtime.GOMAXPROCS(Conf.MaxProc)
+	runtime.GOMAXPROCS(Conf().MaxProc)
 	// init log
-	log.LoadConfiguration(Conf.Log)
+	log.LoadConfiguration(Conf().Log)
 	defer log.Close()
 	// start pprof http
-	perf.Init(Conf.PprofBind)
+	perf.Init(Conf().PprofBind)
+	// start stat http
+	StartStats()
 	// Initialize redis
 	if err := InitStorage(); err != nil {
 		panic(err)
@@ -55,7 +57,7 @@ func main() {
 		panic(err)
 	}
 	// process init
-	if err = process.Init(Conf.User, Conf.Dir, Conf.PidFile); err != nil {
+	if err = process.Init(Conf().User, Conf().Dir, Conf().PidFile); err != nil {
 		panic(err)
 	}
 	// init signals, block wait signals
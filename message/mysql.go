@@ -21,24 +21,52 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/Terry-Mao/gopush-cluster/ketama"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	_ "github.com/go-sql-driver/mysql"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	savePrivateMsgSQL = "INSERT INTO private_msg(skey,mid,ttl,msg,ctime,mtime) VALUES(?,?,?,?,?,?)"
-	// TODO limit
-	getPrivateMsgSQL        = "SELECT mid, ttl, msg FROM private_msg WHERE skey=? AND mid>? ORDER BY mid"
+	savePrivateMsgSQL = "INSERT INTO private_msg(skey,mid,seq,ttl,msg,ctime,mtime) VALUES(?,?,?,?,?,?,?)"
+	// the LAST_INSERT_ID(expr) makes the increased sequence as the insert id
+	incrPrivateSeqSQL = "INSERT INTO private_seq(skey,seq,ctime,mtime) VALUES(?,LAST_INSERT_ID(1),?,?) ON DUPLICATE KEY UPDATE seq=LAST_INSERT_ID(seq+1),mtime=VALUES(mtime)"
+	// multi-row statements of SavePrivates, the values are joined by the keys
+	savePrivateMsgsSQL      = "INSERT INTO private_msg(skey,mid,seq,ttl,msg,ctime,mtime) VALUES %s"
+	incrPrivateSeqsSQL      = "INSERT INTO private_seq(skey,seq,ctime,mtime) VALUES %s ON DUPLICATE KEY UPDATE seq=seq+1,mtime=VALUES(mtime)"
+	getPrivateSeqsSQL       = "SELECT skey, seq FROM private_seq WHERE skey IN (%s)"
+	getPrivateMsgSQL        = "SELECT mid, seq, ttl, msg FROM private_msg WHERE skey=? AND mid>? ORDER BY mid"
+	getPrivateMsgLimitSQL   = "SELECT mid, seq, ttl, msg FROM private_msg WHERE skey=? AND mid>? AND ttl>? ORDER BY mid LIMIT ?"
+	getPrivateMsgBySeqSQL   = "SELECT mid, seq, ttl, msg FROM private_msg WHERE skey=? AND seq>=? AND seq<=? ORDER BY seq"
+	getPrivateSeqPageSQL    = "SELECT mid, seq, ttl, msg FROM private_msg WHERE skey=? AND seq>=? AND seq<=? AND ttl>? ORDER BY seq LIMIT ?"
 	delExpiredPrivateMsgSQL = "DELETE FROM private_msg WHERE ttl<=?"
 	delPrivateMsgSQL        = "DELETE FROM private_msg WHERE skey=?"
+	delPrivateMsgByMidSQL   = "DELETE FROM private_msg WHERE skey=? AND mid=?"
+	savePublicMsgSQL        = "INSERT INTO public_msg(mid,ttl,msg,ctime,mtime) VALUES(?,?,?,?,?)"
+	getPublicMsgSQL         = "SELECT mid, ttl, msg FROM public_msg WHERE mid>? ORDER BY mid"
+	getPublicMsgLimitSQL    = "SELECT mid, ttl, msg FROM public_msg WHERE mid>? AND ttl>? ORDER BY mid LIMIT ?"
+	delExpiredPublicMsgSQL  = "DELETE FROM public_msg WHERE ttl<=?"
+	saveGroupMsgSQL         = "INSERT INTO group_msg(gid,mid,ttl,msg,ctime,mtime) VALUES(?,?,?,?,?,?)"
+	getGroupMsgSQL          = "SELECT mid, ttl, msg FROM group_msg WHERE gid=? AND mid>? ORDER BY mid"
+	getGroupMsgLimitSQL     = "SELECT mid, ttl, msg FROM group_msg WHERE gid=? AND mid>? AND ttl>? ORDER BY mid LIMIT ?"
+	delExpiredGroupMsgSQL   = "DELETE FROM group_msg WHERE ttl<=?"
+	addGroupMemberSQL       = "INSERT IGNORE INTO group_member(gid,skey,ctime,mtime) VALUES(?,?,?,?)"
+	delGroupMemberSQL       = "DELETE FROM group_member WHERE gid=? AND skey=?"
+	getGroupMembersSQL      = "SELECT skey FROM group_member WHERE gid=?"
+	getGroupsSQL            = "SELECT gid FROM group_member WHERE skey=?"
+	saveRevokeSQL           = "INSERT INTO token_revoke(skey,rtime,ttl,ctime,mtime) VALUES(?,?,?,?,?) ON DUPLICATE KEY UPDATE rtime=VALUES(rtime),ttl=VALUES(ttl),mtime=VALUES(mtime)"
+	getRevokeSQL            = "SELECT rtime FROM token_revoke WHERE skey=? AND ttl>?"
+	delExpiredRevokeSQL     = "DELETE FROM token_revoke WHERE ttl<=?"
 )
 
 var (
 	ErrNoMySQLConn     = errors.New("can't get a mysql db")
+	ErrPrivateSeq      = errors.New("private message sequence not found")
 	mysqlSourceSpliter = ":"
 )
 
@@ -52,7 +80,7 @@ type MySQLStorage struct {
 func NewMySQLStorage() *MySQLStorage {
 	dbPool := make(map[string]*sql.DB)
 	ring := ketama.NewRing(ketamaBase)
-	for n, source := range Conf.MySQLSource {
+	for n, source := range Conf().MySQLSource {
 		nw := strings.Split(n, mysqlSourceSpliter)
 		if len(nw) != 2 {
 			err := errors.New("node config error, it's nodeN:W")
@@ -79,38 +107,318 @@ func NewMySQLStorage() *MySQLStorage {
 }
 
 // SavePrivate implements the Storage SavePrivate method.
-func (s *MySQLStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) error {
+// The sequence is increased in the same transaction, so it's consecutive and
+// the order is the same as the commit order of the key.
+func (s *MySQLStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) (int64, error) {
 	db := s.getConn(key)
 	if db == nil {
-		return ErrNoMySQLConn
+		return 0, ErrNoMySQLConn
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("db.Begin() error(%v)", err)
+		return 0, err
 	}
 	now := time.Now()
-	_, err := db.Exec(savePrivateMsgSQL, key, mid, now.Unix()+int64(expire), []byte(msg), now, now)
+	res, err := tx.Exec(incrPrivateSeqSQL, key, now, now)
+	if err != nil {
+		tx.Rollback()
+		log.Error("tx.Exec(\"%s\",\"%s\",now,now) failed (%v)", incrPrivateSeqSQL, key, err)
+		return 0, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		log.Error("res.LastInsertId() error(%v)", err)
+		return 0, err
+	}
+	if _, err = tx.Exec(savePrivateMsgSQL, key, mid, seq, now.Unix()+int64(expire), []byte(msg), now, now); err != nil {
+		tx.Rollback()
+		log.Error("tx.Exec(\"%s\",\"%s\",%d,%d,%d,\"%s\",now,now) failed (%v)", savePrivateMsgSQL, key, mid, seq, expire, string(msg), err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error("tx.Commit() error(%v)", err)
+		return 0, err
+	}
+	return seq, nil
+}
+
+// SavePrivates implements the Storage SavePrivates method.
+// The keys are split as node and saved in transactions of saveBatchNum keys,
+// all the keys of a failed transaction are failed, the others are not
+// affected.
+func (s *MySQLStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) (map[string]int64, []string, error) {
+	// split as node, ignore the duplicate key
+	nodes := map[string][]string{}
+	dup := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if dup[k] {
+			continue
+		}
+		dup[k] = true
+		node := s.ring.Hash(k)
+		nodes[node] = append(nodes[node], k)
+	}
+	var (
+		seqs  = make(map[string]int64, len(keys))
+		fkeys []string
+		err   error
+	)
+	for n, k := range nodes {
+		db, ok := s.pool[n]
+		if !ok {
+			log.Warn("mysql node: \"%s\" not in pool", n)
+			fkeys = append(fkeys, k...)
+			err = ErrNoMySQLConn
+			continue
+		}
+		// lock the sequence rows in the same order, avoid deadlock
+		sort.Strings(k)
+		for i := 0; i < len(k); i += saveBatchNum {
+			j := i + saveBatchNum
+			if j > len(k) {
+				j = len(k)
+			}
+			if berr := savePrivates(db, k[i:j], msg, mid, expire, seqs); berr != nil {
+				fkeys = append(fkeys, k[i:j]...)
+				err = berr
+			}
+		}
+	}
+	return seqs, fkeys, err
+}
+
+// savePrivates save the message of the keys in a transaction, the keys must
+// be in the same node, the increased sequences are set to seqs.
+func savePrivates(db *sql.DB, keys []string, msg json.RawMessage, mid int64, expire uint, seqs map[string]int64) error {
+	tx, err := db.Begin()
 	if err != nil {
-		log.Error("db.Exec(\"%s\",\"%s\",%d,%d,%d,\"%s\",now,now) failed (%v)", savePrivateMsgSQL, key, mid, expire, string(msg), err)
+		log.Error("db.Begin() error(%v)", err)
 		return err
 	}
+	now := time.Now()
+	// increase the sequences
+	args := make([]interface{}, 0, len(keys)*7)
+	for _, key := range keys {
+		args = append(args, key, now, now)
+	}
+	query := fmt.Sprintf(incrPrivateSeqsSQL, placeholders("(?,1,?,?)", len(keys)))
+	if _, err = tx.Exec(query, args...); err != nil {
+		tx.Rollback()
+		log.Error("tx.Exec(\"%s\", %d keys) failed (%v)", incrPrivateSeqsSQL, len(keys), err)
+		return err
+	}
+	// get the increased sequences, the rows are locked by the transaction
+	args = args[:0]
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	query = fmt.Sprintf(getPrivateSeqsSQL, placeholders("?", len(keys)))
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		tx.Rollback()
+		log.Error("tx.Query(\"%s\", %d keys) failed (%v)", getPrivateSeqsSQL, len(keys), err)
+		return err
+	}
+	kseqs := make(map[string]int64, len(keys))
+	for rows.Next() {
+		key := ""
+		seq := int64(0)
+		if err = rows.Scan(&key, &seq); err != nil {
+			rows.Close()
+			tx.Rollback()
+			log.Error("rows.Scan() failed (%v)", err)
+			return err
+		}
+		kseqs[key] = seq
+	}
+	rows.Close()
+	// save the messages
+	args = args[:0]
+	ttl := now.Unix() + int64(expire)
+	for _, key := range keys {
+		seq, ok := kseqs[key]
+		if !ok {
+			tx.Rollback()
+			log.Error("user_key: \"%s\" error(%v)", key, ErrPrivateSeq)
+			return ErrPrivateSeq
+		}
+		args = append(args, key, mid, seq, ttl, []byte(msg), now, now)
+	}
+	query = fmt.Sprintf(savePrivateMsgsSQL, placeholders("(?,?,?,?,?,?,?)", len(keys)))
+	if _, err = tx.Exec(query, args...); err != nil {
+		tx.Rollback()
+		log.Error("tx.Exec(\"%s\", %d keys, %d, \"%s\") failed (%v)", savePrivateMsgsSQL, len(keys), mid, string(msg), err)
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error("tx.Commit() error(%v)", err)
+		return err
+	}
+	for _, key := range keys {
+		seqs[key] = kseqs[key]
+	}
 	return nil
 }
 
-// SavePrivates implements the Storage SavePrivates method.
-func (s *MySQLStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) ([]string, error) {
-	// TODO
-	return nil, nil
+// placeholders join n placeholder groups by ",", eg: "(?,?),(?,?)".
+func placeholders(group string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(group+",", n), ",")
 }
 
 // GetPrivate implements the Storage GetPrivate method.
-func (s *MySQLStorage) GetPrivate(key string, mid int64) ([]*myrpc.Message, error) {
+func (s *MySQLStorage) GetPrivate(key string, mid int64, limit int) ([]*myrpc.Message, int64, error) {
 	db := s.getConn(key)
 	if db == nil {
-		return nil, ErrNoMySQLConn
+		return nil, 0, ErrNoMySQLConn
+	}
+	query, args := getPrivateMsgSQL, []interface{}{key, mid}
+	if limit > 0 {
+		// get one more to know if there are more messages, the expired are
+		// not counted
+		query, args = getPrivateMsgLimitSQL, append(args, time.Now().Unix(), limit+1)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Error("db.Query(\"%s\",\"%s\",%d,%d) failed (%v)", query, key, mid, limit, err)
+		return nil, 0, err
 	}
+	return privateMsgs(key, rows, limit)
+}
+
+// GetPrivateSeq implements the Storage GetPrivateSeq method.
+func (s *MySQLStorage) GetPrivateSeq(key string, from, to int64, limit int) ([]*myrpc.Message, int64, error) {
+	db := s.getConn(key)
+	if db == nil {
+		return nil, 0, ErrNoMySQLConn
+	}
+	var (
+		rows  *sql.Rows
+		err   error
+		query = getPrivateMsgBySeqSQL
+	)
+	if limit > 0 {
+		// get one more to know if there are more messages
+		query = getPrivateSeqPageSQL
+		rows, err = db.Query(query, key, from, to, time.Now().Unix(), limit+1)
+	} else {
+		rows, err = db.Query(query, key, from, to)
+	}
+	if err != nil {
+		log.Error("db.Query(\"%s\",\"%s\",%d,%d,%d) failed (%v)", query, key, from, to, limit, err)
+		return nil, 0, err
+	}
+	msgs, cursor, err := privateMsgs(key, rows, limit)
+	if err != nil || cursor == 0 {
+		return msgs, 0, err
+	}
+	// the next page starts after the last of the page
+	return msgs, msgs[len(msgs)-1].Seq + 1, nil
+}
+
+// privateMsgs scan at most limit (0 means no limit) private messages from the
+// rows, skip the expired, return the next page cursor if there are more rows.
+func privateMsgs(key string, rows *sql.Rows, limit int) ([]*myrpc.Message, int64, error) {
+	defer rows.Close()
 	now := time.Now().Unix()
-	rows, err := db.Query(getPrivateMsgSQL, key, mid)
+	msgs := []*myrpc.Message{}
+	for rows.Next() {
+		expire := int64(0)
+		cmid := int64(0)
+		seq := int64(0)
+		msg := []byte{}
+		if err := rows.Scan(&cmid, &seq, &expire, &msg); err != nil {
+			log.Error("rows.Scan() failed (%v)", err)
+			return nil, 0, err
+		}
+		if now > expire {
+			log.Warn("user_key: \"%s\" mid: %d expired", key, cmid)
+			continue
+		}
+		if limit > 0 && len(msgs) == limit {
+			// the extra row, the last of the page is the cursor
+			return msgs, msgs[limit-1].MsgId, nil
+		}
+		msgs = append(msgs, &myrpc.Message{MsgId: cmid, Seq: seq, GroupId: myrpc.PrivateGroupId, Msg: json.RawMessage(msg)})
+	}
+	return msgs, 0, nil
+}
+
+// SavePublic implements the Storage SavePublic method.
+func (s *MySQLStorage) SavePublic(msg json.RawMessage, mid int64, expire uint) error {
+	db := s.getConn(publicKey)
+	if db == nil {
+		return ErrNoMySQLConn
+	}
+	now := time.Now()
+	_, err := db.Exec(savePublicMsgSQL, mid, now.Unix()+int64(expire), []byte(msg), now, now)
 	if err != nil {
-		log.Error("db.Query(\"%s\",\"%s\",%d,now) failed (%v)", getPrivateMsgSQL, key, mid, err)
-		return nil, err
+		log.Error("db.Exec(\"%s\",%d,%d,\"%s\",now,now) failed (%v)", savePublicMsgSQL, mid, expire, string(msg), err)
+		return err
+	}
+	return nil
+}
+
+// GetPublic implements the Storage GetPublic method.
+func (s *MySQLStorage) GetPublic(mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	db := s.getConn(publicKey)
+	if db == nil {
+		return nil, 0, ErrNoMySQLConn
+	}
+	query, args := getPublicMsgSQL, []interface{}{mid}
+	if limit > 0 {
+		// get one more to know if there are more messages
+		query, args = getPublicMsgLimitSQL, append(args, time.Now().Unix(), limit+1)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Error("db.Query(\"%s\",%d,%d) failed (%v)", query, mid, limit, err)
+		return nil, 0, err
+	}
+	return groupMsgs(myrpc.PublicGroupId, rows, limit)
+}
+
+// SaveGroup implements the Storage SaveGroup method.
+func (s *MySQLStorage) SaveGroup(gid uint, msg json.RawMessage, mid int64, expire uint) error {
+	db := s.getConn(groupKey(gid))
+	if db == nil {
+		return ErrNoMySQLConn
+	}
+	now := time.Now()
+	_, err := db.Exec(saveGroupMsgSQL, gid, mid, now.Unix()+int64(expire), []byte(msg), now, now)
+	if err != nil {
+		log.Error("db.Exec(\"%s\",%d,%d,%d,\"%s\",now,now) failed (%v)", saveGroupMsgSQL, gid, mid, expire, string(msg), err)
+		return err
+	}
+	return nil
+}
+
+// GetGroup implements the Storage GetGroup method.
+func (s *MySQLStorage) GetGroup(gid uint, mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	db := s.getConn(groupKey(gid))
+	if db == nil {
+		return nil, 0, ErrNoMySQLConn
+	}
+	query, args := getGroupMsgSQL, []interface{}{gid, mid}
+	if limit > 0 {
+		// get one more to know if there are more messages
+		query, args = getGroupMsgLimitSQL, append(args, time.Now().Unix(), limit+1)
 	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Error("db.Query(\"%s\",%d,%d,%d) failed (%v)", query, gid, mid, limit, err)
+		return nil, 0, err
+	}
+	return groupMsgs(gid, rows, limit)
+}
+
+// groupMsgs scan at most limit (0 means no limit) public or group messages
+// from the rows, skip the expired, return the next page cursor if there are
+// more rows.
+func groupMsgs(gid uint, rows *sql.Rows, limit int) ([]*myrpc.Message, int64, error) {
+	defer rows.Close()
+	now := time.Now().Unix()
 	msgs := []*myrpc.Message{}
 	for rows.Next() {
 		expire := int64(0)
@@ -118,15 +426,114 @@ func (s *MySQLStorage) GetPrivate(key string, mid int64) ([]*myrpc.Message, erro
 		msg := []byte{}
 		if err := rows.Scan(&cmid, &expire, &msg); err != nil {
 			log.Error("rows.Scan() failed (%v)", err)
-			return nil, err
+			return nil, 0, err
 		}
 		if now > expire {
-			log.Warn("user_key: \"%s\" mid: %d expired", key, cmid)
+			log.Warn("group: %d mid: %d expired", gid, cmid)
 			continue
 		}
-		msgs = append(msgs, &myrpc.Message{MsgId: cmid, GroupId: myrpc.PrivateGroupId, Msg: json.RawMessage(msg)})
+		if limit > 0 && len(msgs) == limit {
+			// the extra row, the last of the page is the cursor
+			return msgs, msgs[limit-1].MsgId, nil
+		}
+		msgs = append(msgs, &myrpc.Message{MsgId: cmid, GroupId: gid, Msg: json.RawMessage(msg)})
+	}
+	return msgs, 0, nil
+}
+
+// AddGroupMember implements the Storage AddGroupMember method.
+// The member is stored both in the group node and the subscriber key node, so
+// it can be found by group id or subscriber key.
+func (s *MySQLStorage) AddGroupMember(gid uint, key string) error {
+	dbs, err := s.groupMemberConns(gid, key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, db := range dbs {
+		if _, err := db.Exec(addGroupMemberSQL, gid, key, now, now); err != nil {
+			log.Error("db.Exec(\"%s\",%d,\"%s\",now,now) failed (%v)", addGroupMemberSQL, gid, key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// DelGroupMember implements the Storage DelGroupMember method.
+func (s *MySQLStorage) DelGroupMember(gid uint, key string) error {
+	dbs, err := s.groupMemberConns(gid, key)
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if _, err := db.Exec(delGroupMemberSQL, gid, key); err != nil {
+			log.Error("db.Exec(\"%s\",%d,\"%s\") failed (%v)", delGroupMemberSQL, gid, key, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGroupMembers implements the Storage GetGroupMembers method.
+func (s *MySQLStorage) GetGroupMembers(gid uint) ([]string, error) {
+	db := s.getConn(groupKey(gid))
+	if db == nil {
+		return nil, ErrNoMySQLConn
+	}
+	rows, err := db.Query(getGroupMembersSQL, gid)
+	if err != nil {
+		log.Error("db.Query(\"%s\",%d) failed (%v)", getGroupMembersSQL, gid, err)
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		key := ""
+		if err := rows.Scan(&key); err != nil {
+			log.Error("rows.Scan() failed (%v)", err)
+			return nil, err
+		}
+		keys = append(keys, key)
 	}
-	return msgs, nil
+	return keys, nil
+}
+
+// GetGroups implements the Storage GetGroups method.
+func (s *MySQLStorage) GetGroups(key string) ([]uint, error) {
+	db := s.getConn(key)
+	if db == nil {
+		return nil, ErrNoMySQLConn
+	}
+	rows, err := db.Query(getGroupsSQL, key)
+	if err != nil {
+		log.Error("db.Query(\"%s\",\"%s\") failed (%v)", getGroupsSQL, key, err)
+		return nil, err
+	}
+	defer rows.Close()
+	gids := []uint{}
+	for rows.Next() {
+		gid := uint(0)
+		if err := rows.Scan(&gid); err != nil {
+			log.Error("rows.Scan() failed (%v)", err)
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	return gids, nil
+}
+
+// groupMemberConns get the group node and the subscriber key node, if they
+// are the same node, only return one.
+func (s *MySQLStorage) groupMemberConns(gid uint, key string) ([]*sql.DB, error) {
+	gdb := s.getConn(groupKey(gid))
+	kdb := s.getConn(key)
+	if gdb == nil || kdb == nil {
+		return nil, ErrNoMySQLConn
+	}
+	if gdb == kdb {
+		return []*sql.DB{gdb}, nil
+	}
+	return []*sql.DB{gdb, kdb}, nil
 }
 
 // DelPrivate implements the Storage DelPrivate method.
@@ -149,6 +556,53 @@ func (s *MySQLStorage) DelPrivate(key string) error {
 	return nil
 }
 
+// SaveRevoke implements the Storage SaveRevoke method.
+func (s *MySQLStorage) SaveRevoke(key string, t int64, expire uint) error {
+	db := s.getConn(key)
+	if db == nil {
+		return ErrNoMySQLConn
+	}
+	now := time.Now()
+	ttl := int64(math.MaxInt64)
+	if expire > 0 {
+		ttl = now.Unix() + int64(expire)
+	}
+	if _, err := db.Exec(saveRevokeSQL, key, t, ttl, now, now); err != nil {
+		log.Error("db.Exec(\"%s\",\"%s\",%d,%d,now,now) failed (%v)", saveRevokeSQL, key, t, ttl, err)
+		return err
+	}
+	return nil
+}
+
+// GetRevoke implements the Storage GetRevoke method.
+func (s *MySQLStorage) GetRevoke(key string) (int64, error) {
+	db := s.getConn(key)
+	if db == nil {
+		return 0, ErrNoMySQLConn
+	}
+	t := int64(0)
+	if err := db.QueryRow(getRevokeSQL, key, time.Now().Unix()).Scan(&t); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		log.Error("db.QueryRow(\"%s\",\"%s\") failed (%v)", getRevokeSQL, key, err)
+		return 0, err
+	}
+	return t, nil
+}
+
+// DelPrivateMsg implements the Storage DelPrivateMsg method.
+func (s *MySQLStorage) DelPrivateMsg(key string, mid int64) error {
+	db := s.getConn(key)
+	if db == nil {
+		return ErrNoMySQLConn
+	}
+	if _, err := db.Exec(delPrivateMsgByMidSQL, key, mid); err != nil {
+		log.Error("db.Exec(\"%s\", \"%s\", %d) error(%v)", delPrivateMsgByMidSQL, key, mid, err)
+		return err
+	}
+	return nil
+}
+
 // clean delete expired messages peroridly.
 func (s *MySQLStorage) clean() {
 	for {
@@ -156,20 +610,22 @@ func (s *MySQLStorage) clean() {
 		now := time.Now().Unix()
 		affect := int64(0)
 		for _, db := range s.pool {
-			res, err := db.Exec(delExpiredPrivateMsgSQL, now)
-			if err != nil {
-				log.Error("db.Exec(\"%s\", %d) failed (%v)", delExpiredPrivateMsgSQL, now, err)
-				continue
-			}
-			aff, err := res.RowsAffected()
-			if err != nil {
-				log.Error("res.RowsAffected() error(%v)", err)
-				continue
+			for _, query := range []string{delExpiredPrivateMsgSQL, delExpiredPublicMsgSQL, delExpiredGroupMsgSQL, delExpiredRevokeSQL} {
+				res, err := db.Exec(query, now)
+				if err != nil {
+					log.Error("db.Exec(\"%s\", %d) failed (%v)", query, now, err)
+					continue
+				}
+				aff, err := res.RowsAffected()
+				if err != nil {
+					log.Error("res.RowsAffected() error(%v)", err)
+					continue
+				}
+				affect += aff
 			}
-			affect += aff
 		}
 		log.Info("clean mysql expired message finish, num: %d", affect)
-		time.Sleep(Conf.MySQLClean)
+		time.Sleep(Conf().MySQLClean)
 	}
 }
 
@@ -23,6 +23,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Terry-Mao/gopush-cluster/ketama"
@@ -34,12 +35,49 @@ import (
 var (
 	RedisNoConnErr       = errors.New("can't get a redis conn")
 	redisProtocolSpliter = "@"
+	// savePrivateScript increase the sequence, save the message with it and
+	// index the message id by it atomically.
+	// KEYS: key, seq key, seq index key
+	// ARGV: mid, the message json without the last "}", trim stop rank
+	savePrivateScript = redis.NewScript(3, `
+local seq = redis.call('INCR', KEYS[2])
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2] .. ',"seq":' .. seq .. '}')
+redis.call('ZREMRANGEBYRANK', KEYS[1], 0, ARGV[3])
+redis.call('ZADD', KEYS[3], seq, ARGV[1])
+redis.call('ZREMRANGEBYRANK', KEYS[3], 0, ARGV[3])
+return seq`)
+	// getPrivateSeqScript get the messages which sequence in [from, to] by
+	// at most limit (0 means no limit) entries of the sequence index, the
+	// reply is the sequence of the extra entry (0 if no more) followed by the
+	// same as ZRANGEBYSCORE WITHSCORES.
+	// KEYS: key, seq index key
+	// ARGV: from, to, limit
+	getPrivateSeqScript = redis.NewScript(2, `
+local limit = tonumber(ARGV[3])
+local idx
+if limit > 0 then
+	idx = redis.call('ZRANGEBYSCORE', KEYS[2], ARGV[1], ARGV[2], 'WITHSCORES', 'LIMIT', 0, limit + 1)
+else
+	idx = redis.call('ZRANGEBYSCORE', KEYS[2], ARGV[1], ARGV[2], 'WITHSCORES')
+end
+local r = {0}
+for i = 1, #idx, 2 do
+	if limit > 0 and i > limit * 2 then
+		r[1] = tonumber(idx[i+1])
+		break
+	end
+	for _, v in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], idx[i], idx[i], 'WITHSCORES')) do
+		r[#r+1] = v
+	end
+end
+return r`)
 )
 
 // RedisMessage struct encoding the composite info.
 type RedisPrivateMessage struct {
-	Msg    json.RawMessage `json:"msg"`    // message content
-	Expire int64           `json:"expire"` // expire second
+	Msg    json.RawMessage `json:"msg"`           // message content
+	Expire int64           `json:"expire"`        // expire second
+	Seq    int64           `json:"seq,omitempty"` // message sequence, only for private message
 }
 
 // Struct for delele message
@@ -49,7 +87,9 @@ type RedisDelMessage struct {
 }
 
 type RedisStorage struct {
-	pool  map[string]*redis.Pool
+	pool  map[string]*redis.Pool // guarded by mutex, replaced when reloading
+	dial  map[string]func() (redis.Conn, error)
+	mutex *sync.RWMutex
 	ring  *ketama.HashRing
 	delCH chan *RedisDelMessage
 }
@@ -57,9 +97,10 @@ type RedisStorage struct {
 // NewRedis initialize the redis pool and consistency hash ring.
 func NewRedisStorage() *RedisStorage {
 	redisPool := map[string]*redis.Pool{}
+	redisDial := map[string]func() (redis.Conn, error){}
 	ring := ketama.NewRing(ketamaBase)
 	reg := regexp.MustCompile("(.+)@(.+)#(.+)|(.+)@(.+)")
-	for n, addr := range Conf.RedisSource {
+	for n, addr := range Conf().RedisSource {
 		nw := strings.Split(n, ":")
 		if len(nw) != 2 {
 			err := errors.New("node config error, it's nodeN:W")
@@ -91,69 +132,118 @@ func NewRedisStorage() *RedisStorage {
 		}
 
 		// WARN: closures use
-		redisPool[nw[0]] = &redis.Pool{
-			MaxIdle:     Conf.RedisMaxIdle,
-			MaxActive:   Conf.RedisMaxActive,
-			IdleTimeout: Conf.RedisIdleTimeout,
-			Dial: func() (redis.Conn, error) {
-				conn, err := redis.Dial(tmpProto, tmpAddr)
-				if err != nil {
-					log.Error("redis.Dial(\"%s\", \"%s\") error(%v)", tmpProto, tmpAddr, err)
-					return nil, err
-				}
-				if pw[3] != "" {
-					conn.Do("AUTH", pw[3])
-				}
-				return conn, err
-			},
+		redisDial[nw[0]] = func() (redis.Conn, error) {
+			conn, err := redis.Dial(tmpProto, tmpAddr)
+			if err != nil {
+				log.Error("redis.Dial(\"%s\", \"%s\") error(%v)", tmpProto, tmpAddr, err)
+				return nil, err
+			}
+			if pw[3] != "" {
+				conn.Do("AUTH", pw[3])
+			}
+			return conn, err
 		}
+		redisPool[nw[0]] = newRedisPool(redisDial[nw[0]])
 		// add node to ketama hash
 		ring.AddNode(nw[0], w)
 	}
 	ring.Bake()
-	s := &RedisStorage{pool: redisPool, ring: ring, delCH: make(chan *RedisDelMessage, 10240)}
+	s := &RedisStorage{pool: redisPool, dial: redisDial, mutex: &sync.RWMutex{}, ring: ring, delCH: make(chan *RedisDelMessage, 10240)}
 	go s.clean()
 	return s
 }
 
+// newRedisPool new a redis pool with the current pool settings.
+func newRedisPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     Conf().RedisMaxIdle,
+		MaxActive:   Conf().RedisMaxActive,
+		IdleTimeout: Conf().RedisIdleTimeout,
+		Dial:        dial,
+	}
+}
+
+// ResetPool replace the pools with the current pool settings when the config
+// reloaded. The old pools are closed, their idle connections are closed at
+// once and the active ones when they are put back.
+func (s *RedisStorage) ResetPool() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for node, dial := range s.dial {
+		old := s.pool[node]
+		s.pool[node] = newRedisPool(dial)
+		if err := old.Close(); err != nil {
+			log.Error("redis node: \"%s\" pool.Close() error(%v)", node, err)
+		}
+	}
+	log.Info("redis pools reset, idle: %d, active: %d, idle timeout: %v", Conf().RedisMaxIdle, Conf().RedisMaxActive, Conf().RedisIdleTimeout)
+}
+
 // SavePrivate implements the Storage SavePrivate method.
-func (s *RedisStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) error {
+func (s *RedisStorage) SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) (int64, error) {
+	return s.save(key, msg, mid, expire, true)
+}
+
+// SavePublic implements the Storage SavePublic method.
+func (s *RedisStorage) SavePublic(msg json.RawMessage, mid int64, expire uint) error {
+	_, err := s.save(publicKey, msg, mid, expire, false)
+	return err
+}
+
+// save save a message to the specified key sorted set, if seq is true,
+// increase the sequence of the key and return it.
+func (s *RedisStorage) save(key string, msg json.RawMessage, mid int64, expire uint, seq bool) (int64, error) {
+	conn := s.getConn(key)
+	if conn == nil {
+		return 0, RedisNoConnErr
+	}
+	defer conn.Close()
 	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix()}
 	m, err := json.Marshal(rm)
 	if err != nil {
 		log.Error("json.Marshal() key:\"%s\" error(%v)", key, err)
-		return err
+		return 0, err
 	}
-	conn := s.getConn(key)
-	if conn == nil {
-		return RedisNoConnErr
+	if seq {
+		// the sequence keys stored in the same node with the key
+		cseq, err := redis.Int64(savePrivateScript.Do(conn, savePrivateArgs(key, mid, m)...))
+		if err != nil {
+			log.Error("savePrivateScript.Do(\"%s\", %d) error(%v)", key, mid, err)
+			return 0, err
+		}
+		return cseq, nil
 	}
-	defer conn.Close()
 	if err = conn.Send("ZADD", key, mid, m); err != nil {
 		log.Error("conn.Send(\"ZADD\", \"%s\", %d, \"%s\") error(%v)", key, mid, string(m), err)
-		return err
+		return 0, err
 	}
-	if err = conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf.RedisMaxStore+1)); err != nil {
-		log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf.RedisMaxStore+1), err)
-		return err
+	if err = conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf().RedisMaxStore+1)); err != nil {
+		log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf().RedisMaxStore+1), err)
+		return 0, err
 	}
 	if err = conn.Flush(); err != nil {
 		log.Error("conn.Flush() error(%v)", err)
-		return err
+		return 0, err
 	}
 	if _, err = conn.Receive(); err != nil {
 		log.Error("conn.Receive() error(%v)", err)
-		return err
+		return 0, err
 	}
 	if _, err = conn.Receive(); err != nil {
 		log.Error("conn.Receive() error(%v)", err)
-		return err
+		return 0, err
 	}
-	return nil
+	return 0, nil
+}
+
+// savePrivateArgs get the savePrivateScript args, m is the json of the
+// message without seq, the script appends the seq to it.
+func savePrivateArgs(key string, mid int64, m []byte) []interface{} {
+	return []interface{}{key, seqKeyPrefix + key, seqIdxKeyPrefix + key, mid, m[:len(m)-1], -1 * (Conf().RedisMaxStore + 1)}
 }
 
 // SavePrivates implements the Storage SavePrivates method.
-func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) (fkeys []string, err error) {
+func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) (seqs map[string]int64, fkeys []string, err error) {
 	// split as node
 	nodes := map[string][]string{}
 	fkeysMap := make(map[string]bool, len(keys))
@@ -174,11 +264,12 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 			fkeys = append(fkeys, k)
 		}
 	}()
-	// raw msg
+	seqs = make(map[string]int64, len(keys))
+	// raw msg, the seq is appended by the script
 	rm := &RedisPrivateMessage{Msg: msg, Expire: int64(expire) + time.Now().Unix()}
 	m, err := json.Marshal(rm)
 	if err != nil {
-		log.Error("json.Marshal() key:\"%s\" error(%v)", keys, err)
+		log.Error("json.Marshal() error(%v)", err)
 		return
 	}
 	// batch
@@ -189,16 +280,16 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 			err = RedisNoConnErr
 			return
 		}
-		// pipeline batch msgs
+		// make sure the script cached, then pipeline by sha1
+		if err = savePrivateScript.Load(conn); err != nil {
+			conn.Close()
+			log.Error("savePrivateScript.Load() node:%s error(%v)", n, err)
+			return
+		}
 		for _, key := range k {
-			if err = conn.Send("ZADD", key, mid, m); err != nil {
+			if err = savePrivateScript.SendHash(conn, savePrivateArgs(key, mid, m)...); err != nil {
 				conn.Close()
-				log.Error("conn.Send(\"ZADD\", \"%s\", %d, \"%s\") error(%v)", key, mid, string(m), err)
-				return
-			}
-			if err = conn.Send("ZREMRANGEBYRANK", key, 0, -1*(Conf.RedisMaxStore+1)); err != nil {
-				conn.Close()
-				log.Error("conn.Send(\"ZREMRANGEBYRANK\", \"%s\", 0, %d) error(%v)", key, -1*(Conf.RedisMaxStore+1), err)
+				log.Error("savePrivateScript.SendHash(\"%s\", %d) error(%v)", key, mid, err)
 				return
 			}
 		}
@@ -209,19 +300,16 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 			return
 		}
 		// receive
-		for j := 0; j < len(k); j++ {
-			if _, err = conn.Receive(); err != nil {
+		for _, key := range k {
+			seq := int64(0)
+			if seq, err = redis.Int64(conn.Receive()); err != nil {
 				conn.Close()
 				log.Error("conn.Receive() error(%v)", err)
 				return
 			}
 			// delete succeed key
-			delete(fkeysMap, k[j])
-			if _, err = conn.Receive(); err != nil {
-				conn.Close()
-				log.Error("conn.Receive() error(%v)", err)
-				return
-			}
+			delete(fkeysMap, key)
+			seqs[key] = seq
 		}
 		conn.Close()
 	}
@@ -229,18 +317,195 @@ func (s *RedisStorage) SavePrivates(keys []string, msg json.RawMessage, mid int6
 }
 
 // GetPrivate implements the Storage GetPrivate method.
-func (s *RedisStorage) GetPrivate(key string, mid int64) ([]*myrpc.Message, error) {
+func (s *RedisStorage) GetPrivate(key string, mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	return s.get(key, mid, limit, myrpc.PrivateGroupId)
+}
+
+// GetPrivateSeq implements the Storage GetPrivateSeq method.
+func (s *RedisStorage) GetPrivateSeq(key string, from, to int64, limit int) ([]*myrpc.Message, int64, error) {
 	conn := s.getConn(key)
+	if conn == nil {
+		return nil, 0, RedisNoConnErr
+	}
+	defer conn.Close()
+	// the sequence index is trimmed as the messages by max.store, the index
+	// of a deleted message is skipped. The first value is the sequence of
+	// the extra index entry, it's the from of the next page
+	values, err := redis.Values(getPrivateSeqScript.Do(conn, key, seqIdxKeyPrefix+key, from, to, limit))
+	if err != nil {
+		log.Error("getPrivateSeqScript.Do(\"%s\", %d, %d, %d) error(%v)", key, from, to, limit, err)
+		return nil, 0, err
+	}
+	cursor := int64(0)
+	if values, err = redis.Scan(values, &cursor); err != nil {
+		log.Error("redis.Scan() error(%v)", err)
+		return nil, 0, err
+	}
+	msgs, err := s.messages(key, values, myrpc.PrivateGroupId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msgs, cursor, nil
+}
+
+// GetPublic implements the Storage GetPublic method.
+func (s *RedisStorage) GetPublic(mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	return s.get(publicKey, mid, limit, myrpc.PublicGroupId)
+}
+
+// SaveGroup implements the Storage SaveGroup method.
+func (s *RedisStorage) SaveGroup(gid uint, msg json.RawMessage, mid int64, expire uint) error {
+	_, err := s.save(groupKey(gid), msg, mid, expire, false)
+	return err
+}
+
+// GetGroup implements the Storage GetGroup method.
+func (s *RedisStorage) GetGroup(gid uint, mid int64, limit int) ([]*myrpc.Message, int64, error) {
+	return s.get(groupKey(gid), mid, limit, gid)
+}
+
+// AddGroupMember implements the Storage AddGroupMember method.
+func (s *RedisStorage) AddGroupMember(gid uint, key string) error {
+	return s.groupMemberDo("SADD", gid, key)
+}
+
+// DelGroupMember implements the Storage DelGroupMember method.
+func (s *RedisStorage) DelGroupMember(gid uint, key string) error {
+	return s.groupMemberDo("SREM", gid, key)
+}
+
+// GetGroupMembers implements the Storage GetGroupMembers method.
+func (s *RedisStorage) GetGroupMembers(gid uint) ([]string, error) {
+	return s.members(groupMemberKey(gid))
+}
+
+// GetGroups implements the Storage GetGroups method.
+func (s *RedisStorage) GetGroups(key string) ([]uint, error) {
+	members, err := s.members(keyGroupKeyPrefix + key)
+	if err != nil {
+		return nil, err
+	}
+	gids := make([]uint, 0, len(members))
+	for _, member := range members {
+		gid, err := strconv.ParseUint(member, 10, 32)
+		if err != nil {
+			log.Error("user_key: \"%s\" strconv.ParseUint(\"%s\", 10, 32) error(%v)", key, member, err)
+			continue
+		}
+		gids = append(gids, uint(gid))
+	}
+	return gids, nil
+}
+
+// groupMemberDo do the set command on the group member set and the subscriber
+// key group set in a transaction. The two sets may hash to different nodes,
+// like mysql the pair is stored in both the group node and the subscriber key
+// node, so each node is always consistent. If the second node failed the
+// error is returned, the command is idempotent and can be retried.
+func (s *RedisStorage) groupMemberDo(cmd string, gid uint, key string) error {
+	if len(s.pool) == 0 {
+		return RedisNoConnErr
+	}
+	gkey, kkey := groupMemberKey(gid), keyGroupKeyPrefix+key
+	gnode, knode := s.ring.Hash(gkey), s.ring.Hash(kkey)
+	nodes := []string{gnode}
+	if knode != gnode {
+		nodes = append(nodes, knode)
+	}
+	for _, node := range nodes {
+		conn := s.getConnByNode(node)
+		if conn == nil {
+			return RedisNoConnErr
+		}
+		err := s.groupMemberMulti(conn, cmd, gkey, kkey, gid, key)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupMemberMulti do the set command on the two sets by MULTI/EXEC.
+func (s *RedisStorage) groupMemberMulti(conn redis.Conn, cmd, gkey, kkey string, gid uint, key string) error {
+	if err := conn.Send("MULTI"); err != nil {
+		log.Error("conn.Send(\"MULTI\") error(%v)", err)
+		return err
+	}
+	if err := conn.Send(cmd, gkey, key); err != nil {
+		log.Error("conn.Send(\"%s\", \"%s\", \"%s\") error(%v)", cmd, gkey, key, err)
+		return err
+	}
+	if err := conn.Send(cmd, kkey, gid); err != nil {
+		log.Error("conn.Send(\"%s\", \"%s\", %d) error(%v)", cmd, kkey, gid, err)
+		return err
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Error("conn.Do(\"EXEC\") error(%v)", err)
+		return err
+	}
+	return nil
+}
+
+// members get all the members of the specified set key.
+func (s *RedisStorage) members(skey string) ([]string, error) {
+	conn := s.getConn(skey)
 	if conn == nil {
 		return nil, RedisNoConnErr
 	}
 	defer conn.Close()
-	values, err := redis.Values(conn.Do("ZRANGEBYSCORE", key, fmt.Sprintf("(%d", mid), "+inf", "WITHSCORES"))
+	members, err := redis.Strings(conn.Do("SMEMBERS", skey))
 	if err != nil {
-		log.Error("conn.Do(\"ZRANGEBYSCORE\", \"%s\", \"%d\", \"+inf\", \"WITHSCORES\") error(%v)", key, mid, err)
+		log.Error("conn.Do(\"SMEMBERS\", \"%s\") error(%v)", skey, err)
 		return nil, err
 	}
-	msgs := make([]*myrpc.Message, 0, len(values))
+	return members, nil
+}
+
+// get get at most limit (0 means no limit) messages which message id greater
+// than mid from the specified key sorted set, return the next page cursor, 0
+// means no more messages.
+func (s *RedisStorage) get(key string, mid int64, limit int, gid uint) ([]*myrpc.Message, int64, error) {
+	conn := s.getConn(key)
+	if conn == nil {
+		return nil, 0, RedisNoConnErr
+	}
+	defer conn.Close()
+	var (
+		values []interface{}
+		err    error
+	)
+	if limit > 0 {
+		// get one more to know if there are more messages
+		values, err = redis.Values(conn.Do("ZRANGEBYSCORE", key, fmt.Sprintf("(%d", mid), "+inf", "WITHSCORES", "LIMIT", 0, limit+1))
+	} else {
+		values, err = redis.Values(conn.Do("ZRANGEBYSCORE", key, fmt.Sprintf("(%d", mid), "+inf", "WITHSCORES"))
+	}
+	if err != nil {
+		log.Error("conn.Do(\"ZRANGEBYSCORE\", \"%s\", \"%d\", \"+inf\", \"WITHSCORES\", %d) error(%v)", key, mid, limit, err)
+		return nil, 0, err
+	}
+	cursor := int64(0)
+	if limit > 0 && len(values) > limit*2 {
+		// drop the extra one, the last of the page is the cursor
+		values = values[:limit*2]
+		if cursor, err = redis.Int64(values[limit*2-1], nil); err != nil {
+			log.Error("redis.Int64() error(%v)", err)
+			return nil, 0, err
+		}
+	}
+	msgs, err := s.messages(key, values, gid)
+	if err != nil {
+		return nil, 0, err
+	}
+	return msgs, cursor, nil
+}
+
+// messages parse the ZRANGEBYSCORE WITHSCORES reply of the specified key, the
+// unmarshal failed and expired messages are skipped and deleted asynchronously.
+func (s *RedisStorage) messages(key string, values []interface{}, gid uint) ([]*myrpc.Message, error) {
+	var err error
+	msgs := make([]*myrpc.Message, 0, len(values)/2)
 	delMsgs := []int64{}
 	now := time.Now().Unix()
 	for len(values) > 0 {
@@ -263,7 +528,7 @@ func (s *RedisStorage) GetPrivate(key string, mid int64) ([]*myrpc.Message, erro
 			delMsgs = append(delMsgs, cmid)
 			continue
 		}
-		m := &myrpc.Message{MsgId: cmid, Msg: rm.Msg, GroupId: myrpc.PrivateGroupId}
+		m := &myrpc.Message{MsgId: cmid, Seq: rm.Seq, Msg: rm.Msg, GroupId: gid}
 		msgs = append(msgs, m)
 	}
 	// delete unmarshal failed and expired message
@@ -284,13 +549,62 @@ func (s *RedisStorage) DelPrivate(key string) error {
 		return RedisNoConnErr
 	}
 	defer conn.Close()
-	if _, err := conn.Do("DEL", key); err != nil {
+	if _, err := conn.Do("DEL", key, seqIdxKeyPrefix+key); err != nil {
 		log.Error("conn.Do(\"DEL\", \"%s\") error(%v)", key, err)
 		return err
 	}
 	return nil
 }
 
+// SaveRevoke implements the Storage SaveRevoke method.
+func (s *RedisStorage) SaveRevoke(key string, t int64, expire uint) error {
+	conn := s.getConn(key)
+	if conn == nil {
+		return RedisNoConnErr
+	}
+	defer conn.Close()
+	args := []interface{}{revokeKeyPrefix + key, t}
+	if expire > 0 {
+		args = append(args, "EX", expire)
+	}
+	if _, err := conn.Do("SET", args...); err != nil {
+		log.Error("conn.Do(\"SET\", \"%s\", %d, %d) error(%v)", revokeKeyPrefix+key, t, expire, err)
+		return err
+	}
+	return nil
+}
+
+// GetRevoke implements the Storage GetRevoke method.
+func (s *RedisStorage) GetRevoke(key string) (int64, error) {
+	conn := s.getConn(key)
+	if conn == nil {
+		return 0, RedisNoConnErr
+	}
+	defer conn.Close()
+	t, err := redis.Int64(conn.Do("GET", revokeKeyPrefix+key))
+	if err == redis.ErrNil {
+		return 0, nil
+	} else if err != nil {
+		log.Error("conn.Do(\"GET\", \"%s\") error(%v)", revokeKeyPrefix+key, err)
+		return 0, err
+	}
+	return t, nil
+}
+
+// DelPrivateMsg implements the Storage DelPrivateMsg method.
+func (s *RedisStorage) DelPrivateMsg(key string, mid int64) error {
+	conn := s.getConn(key)
+	if conn == nil {
+		return RedisNoConnErr
+	}
+	defer conn.Close()
+	if _, err := conn.Do("ZREMRANGEBYSCORE", key, mid, mid); err != nil {
+		log.Error("conn.Do(\"ZREMRANGEBYSCORE\", \"%s\", %d, %d) error(%v)", key, mid, mid, err)
+		return err
+	}
+	return nil
+}
+
 // DelMulti implements the Storage DelMulti method.
 func (s *RedisStorage) clean() {
 	for {
@@ -335,6 +649,9 @@ func (s *RedisStorage) getConn(key string) redis.Conn {
 }
 
 func (s *RedisStorage) getConnByNode(node string) redis.Conn {
+	// get under the lock, the pool may be closed by ResetPool
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	p, ok := s.pool[node]
 	if !ok {
 		log.Warn("no node: \"%s\" in redis pool", node)
@@ -19,19 +19,55 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
+	"math"
 	"net"
 	"net/rpc"
+	"sort"
 )
 
 // RPC For receive offline messages
 type MessageRPC struct {
 }
 
+type byMsgId []*myrpc.Message
+
+// Len is part of sort.Interface.
+func (m byMsgId) Len() int {
+	return len(m)
+}
+
+// Swap is part of sort.Interface.
+func (m byMsgId) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+
+// Less is part of sort.Interface.
+func (m byMsgId) Less(i, j int) bool {
+	return m[i].MsgId < m[j].MsgId
+}
+
+type bySeq []*myrpc.Message
+
+// Len is part of sort.Interface.
+func (m bySeq) Len() int {
+	return len(m)
+}
+
+// Swap is part of sort.Interface.
+func (m bySeq) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+
+// Less is part of sort.Interface.
+func (m bySeq) Less(i, j int) bool {
+	return m[i].Seq < m[j].Seq
+}
+
 // InitRPC start accept rpc call.
 func InitRPC() error {
 	msg := &MessageRPC{}
 	rpc.Register(msg)
-	for _, bind := range Conf.RPCBind {
+	for _, bind := range Conf().RPCBind {
 		log.Info("start rpc listen addr: \"%s\"", bind)
 		go rpcListen(bind)
 	}
@@ -53,16 +89,19 @@ func rpcListen(bind string) {
 	rpc.Accept(l)
 }
 
-// SavePrivate rpc interface save user private message.
-func (r *MessageRPC) SavePrivate(m *myrpc.MessageSavePrivateArgs, ret *int) error {
+// SavePrivate rpc interface save user private message, reply the message
+// sequence of the user.
+func (r *MessageRPC) SavePrivate(m *myrpc.MessageSavePrivateArgs, seq *int64) error {
 	if m == nil || m.Msg == nil || m.MsgId < 0 {
 		return myrpc.ErrParam
 	}
-	if err := UseStorage.SavePrivate(m.Key, m.Msg, m.MsgId, m.Expire); err != nil {
+	s, err := UseStorage.SavePrivate(m.Key, m.Msg, m.MsgId, m.Expire)
+	if err != nil {
 		log.Error("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d) error(%v)", m.Key, string(m.Msg), m.MsgId, m.Expire, err)
 		return err
 	}
-	log.Debug("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d) ok", m.Key, string(m.Msg), m.MsgId, m.Expire)
+	*seq = s
+	log.Debug("UseStorage.SavePrivate(\"%s\", \"%s\", %d, %d) ok seq:%d", m.Key, string(m.Msg), m.MsgId, m.Expire, s)
 	return nil
 }
 
@@ -71,28 +110,55 @@ func (r *MessageRPC) SavePrivates(m *myrpc.MessageSavePrivatesArgs, rw *myrpc.Me
 	if m == nil || m.Msg == nil || m.MsgId < 0 {
 		return myrpc.ErrParam
 	}
-	fkeys, err := UseStorage.SavePrivates(m.Keys, m.Msg, m.MsgId, m.Expire)
+	seqs, fkeys, err := UseStorage.SavePrivates(m.Keys, m.Msg, m.MsgId, m.Expire)
 	if err != nil {
 		log.Error("UseStorage.SavePrivates(\"%v\", \"%s\", %d, %d) error(%v)", m.Keys, string(m.Msg), m.MsgId, m.Expire, err)
 	}
 	rw.FKeys = fkeys
+	rw.Seqs = seqs
 	log.Debug("UseStorage.SavePrivates(\"%v\", \"%s\", %d, %d) ok fkeys len(%d)", m.Keys, string(m.Msg), m.MsgId, m.Expire, len(fkeys))
 	return nil
 }
 
 // GetPrivate rpc interface get user private message.
 func (r *MessageRPC) GetPrivate(m *myrpc.MessageGetPrivateArgs, rw *myrpc.MessageGetResp) error {
-	log.Debug("messageRPC.GetPrivate key:\"%s\" mid:\"%d\"", m.Key, m.MsgId)
-	if m == nil || m.Key == "" || m.MsgId < 0 {
+	if m == nil || m.Key == "" || m.MsgId < 0 || m.Limit < 0 {
 		return myrpc.ErrParam
 	}
-	msgs, err := UseStorage.GetPrivate(m.Key, m.MsgId)
+	log.Debug("messageRPC.GetPrivate key:\"%s\" mid:\"%d\" limit:%d", m.Key, m.MsgId, m.Limit)
+	msgs, cursor, err := UseStorage.GetPrivate(m.Key, m.MsgId, m.Limit)
 	if err != nil {
-		log.Error("UseStorage.GetPrivate(\"%s\", %d) error(%v)", m.Key, m.MsgId, err)
+		log.Error("UseStorage.GetPrivate(\"%s\", %d, %d) error(%v)", m.Key, m.MsgId, m.Limit, err)
 		return err
 	}
 	rw.Msgs = msgs
-	log.Debug("UserStorage.GetPrivate(\"%s\", %d) ok", m.Key, m.MsgId)
+	rw.HasMore = cursor > 0
+	rw.Cursor = cursor
+	log.Debug("UserStorage.GetPrivate(\"%s\", %d, %d) ok cursor:%d", m.Key, m.MsgId, m.Limit, cursor)
+	return nil
+}
+
+// GetPrivateSeq rpc interface get user private message by the sequence range,
+// the messages are sorted by sequence, the cursor is the from of the next
+// page.
+func (r *MessageRPC) GetPrivateSeq(m *myrpc.MessageGetPrivateSeqArgs, rw *myrpc.MessageGetResp) error {
+	if m == nil || m.Key == "" || m.From < 0 || m.To < 0 || (m.To > 0 && m.To < m.From) || m.Limit < 0 {
+		return myrpc.ErrParam
+	}
+	to := m.To
+	if to == 0 {
+		to = math.MaxInt64
+	}
+	msgs, cursor, err := UseStorage.GetPrivateSeq(m.Key, m.From, to, m.Limit)
+	if err != nil {
+		log.Error("UseStorage.GetPrivateSeq(\"%s\", %d, %d, %d) error(%v)", m.Key, m.From, to, m.Limit, err)
+		return err
+	}
+	sort.Sort(bySeq(msgs))
+	rw.Msgs = msgs
+	rw.HasMore = cursor > 0
+	rw.Cursor = cursor
+	log.Debug("UserStorage.GetPrivateSeq(\"%s\", %d, %d, %d) ok cursor:%d", m.Key, m.From, to, m.Limit, cursor)
 	return nil
 }
 
@@ -109,37 +175,173 @@ func (r *MessageRPC) DelPrivate(key string, ret *int) error {
 	return nil
 }
 
-/*
-// SavePublish rpc interface save publish message.
-func (r *MessageRPC) SavePublish(m *myrpc.MessageSaveGroupArgs, ret *int) error {
+// AckPrivate rpc interface delete the user private message acked by client.
+func (r *MessageRPC) AckPrivate(m *myrpc.MessageAckPrivateArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.MsgId <= 0 {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.DelPrivateMsg(m.Key, m.MsgId); err != nil {
+		log.Error("UseStorage.DelPrivateMsg(\"%s\", %d) error(%v)", m.Key, m.MsgId, err)
+		return err
+	}
+	log.Debug("UseStorage.DelPrivateMsg(\"%s\", %d) ok", m.Key, m.MsgId)
 	return nil
 }
 
-// GetPublish rpc interface get publish message.
-func (r *MessageRPC) GetPublish(m *myrpc.MessageGetGroupArgs, rw *myrpc.MessageGetResp) error {
+// SavePublic rpc interface save public message.
+func (r *MessageRPC) SavePublic(m *myrpc.MessageSavePublicArgs, ret *int) error {
+	if m == nil || m.Msg == nil || m.MsgId < 0 {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.SavePublic(m.Msg, m.MsgId, m.Expire); err != nil {
+		log.Error("UseStorage.SavePublic(\"%s\", %d, %d) error(%v)", string(m.Msg), m.MsgId, m.Expire, err)
+		return err
+	}
+	log.Debug("UseStorage.SavePublic(\"%s\", %d, %d) ok", string(m.Msg), m.MsgId, m.Expire)
 	return nil
 }
 
-// DelPublish rpc interface delete publish message.
-func (r *MessageRPC) DelPublish(key string, ret *int) error {
+// GetPublic rpc interface get public message.
+func (r *MessageRPC) GetPublic(m *myrpc.MessageGetPublicArgs, rw *myrpc.MessageGetResp) error {
+	if m == nil || m.MsgId < 0 || m.Limit < 0 {
+		return myrpc.ErrParam
+	}
+	msgs, cursor, err := UseStorage.GetPublic(m.MsgId, m.Limit)
+	if err != nil {
+		log.Error("UseStorage.GetPublic(%d, %d) error(%v)", m.MsgId, m.Limit, err)
+		return err
+	}
+	rw.Msgs = msgs
+	rw.HasMore = cursor > 0
+	rw.Cursor = cursor
+	log.Debug("UserStorage.GetPublic(%d, %d) ok cursor:%d", m.MsgId, m.Limit, cursor)
 	return nil
 }
 
-// SaveGroup rpc interface save publish message.
+// SaveGroup rpc interface save group message.
 func (r *MessageRPC) SaveGroup(m *myrpc.MessageSaveGroupArgs, ret *int) error {
+	if m == nil || m.Msg == nil || m.MsgId < 0 || m.GroupId <= myrpc.PublicGroupId {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.SaveGroup(m.GroupId, m.Msg, m.MsgId, m.Expire); err != nil {
+		log.Error("UseStorage.SaveGroup(%d, \"%s\", %d, %d) error(%v)", m.GroupId, string(m.Msg), m.MsgId, m.Expire, err)
+		return err
+	}
+	log.Debug("UseStorage.SaveGroup(%d, \"%s\", %d, %d) ok", m.GroupId, string(m.Msg), m.MsgId, m.Expire)
 	return nil
 }
 
-// GetPublish rpc interface get publish message.
+// GetGroup rpc interface get the group messages of all groups the user joined,
+// the groups are paged together by the message id.
 func (r *MessageRPC) GetGroup(m *myrpc.MessageGetGroupArgs, rw *myrpc.MessageGetResp) error {
+	if m == nil || m.Key == "" || m.MsgId < 0 || m.Limit < 0 {
+		return myrpc.ErrParam
+	}
+	gids, err := UseStorage.GetGroups(m.Key)
+	if err != nil {
+		log.Error("UseStorage.GetGroups(\"%s\") error(%v)", m.Key, err)
+		return err
+	}
+	msgs := []*myrpc.Message{}
+	// the min next page cursor of the groups
+	cursor := int64(0)
+	for _, gid := range gids {
+		gmsgs, gcursor, err := UseStorage.GetGroup(gid, m.MsgId, m.Limit)
+		if err != nil {
+			log.Error("UseStorage.GetGroup(%d, %d, %d) error(%v)", gid, m.MsgId, m.Limit, err)
+			return err
+		}
+		if gcursor > 0 && (cursor == 0 || gcursor < cursor) {
+			cursor = gcursor
+		}
+		msgs = append(msgs, gmsgs...)
+	}
+	sort.Sort(byMsgId(msgs))
+	// the messages of all the groups are complete till the min cursor, the
+	// later ones are got by the next page
+	if cursor > 0 {
+		msgs = msgs[:sort.Search(len(msgs), func(i int) bool { return msgs[i].MsgId > cursor })]
+	}
+	if m.Limit > 0 && len(msgs) > m.Limit {
+		msgs = msgs[:m.Limit]
+		cursor = msgs[m.Limit-1].MsgId
+	}
+	rw.Msgs = msgs
+	rw.HasMore = cursor > 0
+	rw.Cursor = cursor
+	log.Debug("UserStorage.GetGroup(\"%s\", %d, %d) ok cursor:%d", m.Key, m.MsgId, m.Limit, cursor)
 	return nil
 }
 
-// DelPublish rpc interface delete publish message.
-func (r *MessageRPC) DelGroup(key string, ret *int) error {
+// AddGroupMember rpc interface add a user to the group.
+func (r *MessageRPC) AddGroupMember(m *myrpc.MessageGroupMemberArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.GroupId <= myrpc.PublicGroupId {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.AddGroupMember(m.GroupId, m.Key); err != nil {
+		log.Error("UseStorage.AddGroupMember(%d, \"%s\") error(%v)", m.GroupId, m.Key, err)
+		return err
+	}
+	log.Debug("UseStorage.AddGroupMember(%d, \"%s\") ok", m.GroupId, m.Key)
+	return nil
+}
+
+// DelGroupMember rpc interface remove a user from the group.
+func (r *MessageRPC) DelGroupMember(m *myrpc.MessageGroupMemberArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.GroupId <= myrpc.PublicGroupId {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.DelGroupMember(m.GroupId, m.Key); err != nil {
+		log.Error("UseStorage.DelGroupMember(%d, \"%s\") error(%v)", m.GroupId, m.Key, err)
+		return err
+	}
+	log.Debug("UseStorage.DelGroupMember(%d, \"%s\") ok", m.GroupId, m.Key)
+	return nil
+}
+
+// GetGroupMembers rpc interface get all the users of the group.
+func (r *MessageRPC) GetGroupMembers(gid uint, rw *myrpc.MessageGetGroupMembersResp) error {
+	if gid <= myrpc.PublicGroupId {
+		return myrpc.ErrParam
+	}
+	keys, err := UseStorage.GetGroupMembers(gid)
+	if err != nil {
+		log.Error("UseStorage.GetGroupMembers(%d) error(%v)", gid, err)
+		return err
+	}
+	rw.Keys = keys
+	log.Debug("UseStorage.GetGroupMembers(%d) ok", gid)
+	return nil
+}
+
+// SaveRevoke rpc interface save the signed token revoke time of the user.
+func (r *MessageRPC) SaveRevoke(m *myrpc.MessageSaveRevokeArgs, ret *int) error {
+	if m == nil || m.Key == "" || m.Time <= 0 {
+		return myrpc.ErrParam
+	}
+	if err := UseStorage.SaveRevoke(m.Key, m.Time, m.Expire); err != nil {
+		log.Error("UseStorage.SaveRevoke(\"%s\", %d, %d) error(%v)", m.Key, m.Time, m.Expire, err)
+		return err
+	}
+	log.Debug("UseStorage.SaveRevoke(\"%s\", %d, %d) ok", m.Key, m.Time, m.Expire)
+	return nil
+}
+
+// GetRevoke rpc interface get the signed token revoke time of the user, 0
+// means not revoked.
+func (r *MessageRPC) GetRevoke(key string, t *int64) error {
+	if key == "" {
+		return myrpc.ErrParam
+	}
+	rt, err := UseStorage.GetRevoke(key)
+	if err != nil {
+		log.Error("UseStorage.GetRevoke(\"%s\") error(%v)", key, err)
+		return err
+	}
+	*t = rt
+	log.Debug("UseStorage.GetRevoke(\"%s\") ok", key)
 	return nil
 }
-*/
 
 // Server Ping interface
 func (r *MessageRPC) Ping(p int, ret *int) error {
@@ -40,8 +40,9 @@ func HandleSignal(c chan os.Signal) {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGINT:
 			return
 		case syscall.SIGHUP:
-			// TODO reload
-			//return
+			// reload config
+			res := ReloadConfig()
+			log.Info("reload config succeed:%t applied:%v restart:%v", res.Succeed, res.Applied, res.Restart)
 		default:
 			return
 		}
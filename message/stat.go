@@ -0,0 +1,65 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	log "github.com/alecthomas/log4go"
+	"encoding/json"
+	"net/http"
+)
+
+// StartStats start stat http listen.
+func StartStats() {
+	for _, bind := range Conf().StatBind {
+		log.Info("start stat listen addr:\"%s\"", bind)
+		go statListen(bind)
+	}
+}
+
+func statListen(bind string) {
+	httpServeMux := http.NewServeMux()
+	httpServeMux.HandleFunc("/stat", StatHandle)
+	if err := http.ListenAndServe(bind, httpServeMux); err != nil {
+		log.Error("http.ListenAdServe(\"%s\") error(%v)", bind, err)
+		panic(err)
+	}
+}
+
+// StatHandle get stat info by http.
+func StatHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	var res interface{}
+	// don't expose config, it contains the storage passwords
+	switch r.URL.Query().Get("type") {
+	case "reload":
+		res = liveConf.Last()
+	default:
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	data, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		log.Error("json.MarshalIndent(\"%v\", \"\", \"    \") error(%v)", res, err)
+		return
+	}
+	if _, err := w.Write(data); err != nil {
+		log.Error("w.Write(\"%s\") error(%v)", string(data), err)
+	}
+}
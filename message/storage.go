@@ -20,6 +20,7 @@ import (
 	log "github.com/alecthomas/log4go"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/Terry-Mao/gopush-cluster/rpc"
 )
 
@@ -28,6 +29,20 @@ const (
 	MySQLStorageType = "mysql"
 	ketamaBase       = 255
 	saveBatchNum     = 1000
+	// public messages stored key
+	publicKey = "gopush_public_msg"
+	// group messages stored key prefix
+	groupKeyPrefix = "gopush_group_msg_"
+	// group members stored key prefix
+	groupMemberKeyPrefix = "gopush_group_member_"
+	// subscriber joined groups stored key prefix
+	keyGroupKeyPrefix = "gopush_key_group_"
+	// private message sequence stored key prefix
+	seqKeyPrefix = "gopush_seq_"
+	// private message sequence index (score seq, member mid) key prefix
+	seqIdxKeyPrefix = "gopush_seqidx_"
+	// signed token revoke time stored key prefix
+	revokeKeyPrefix = "gopush_revoke_"
 )
 
 var (
@@ -37,24 +52,65 @@ var (
 
 // Stored messages interface
 type Storage interface {
-	// GetPrivate get private msgs.
-	GetPrivate(key string, mid int64) ([]*rpc.Message, error)
-	// SavePrivate Save single private msg.
-	SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) error
-	// Save private msgs return failed keys.
-	SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) ([]string, error)
+	// GetPrivate get at most limit (0 means no limit) private msgs after the
+	// mid, return the next page cursor, 0 means no more msgs.
+	GetPrivate(key string, mid int64, limit int) ([]*rpc.Message, int64, error)
+	// GetPrivateSeq get at most limit (0 means no limit) private msgs which
+	// sequence in [from, to], return the from of the next page, 0 means no
+	// more msgs.
+	GetPrivateSeq(key string, from, to int64, limit int) ([]*rpc.Message, int64, error)
+	// SavePrivate Save single private msg, return the msg sequence of the key.
+	SavePrivate(key string, msg json.RawMessage, mid int64, expire uint) (int64, error)
+	// Save private msgs return the msg sequence of succeed keys and failed keys.
+	SavePrivates(keys []string, msg json.RawMessage, mid int64, expire uint) (map[string]int64, []string, error)
 	// DelPrivate delete private msgs.
 	DelPrivate(key string) error
+	// DelPrivateMsg delete a single private msg, called when client acked.
+	DelPrivateMsg(key string, mid int64) error
+	// GetPublic get at most limit (0 means no limit) public msgs after the
+	// mid, return the next page cursor, 0 means no more msgs.
+	GetPublic(mid int64, limit int) ([]*rpc.Message, int64, error)
+	// SavePublic save single public msg.
+	SavePublic(msg json.RawMessage, mid int64, expire uint) error
+	// GetGroup get at most limit (0 means no limit) group msgs after the mid,
+	// return the next page cursor, 0 means no more msgs.
+	GetGroup(gid uint, mid int64, limit int) ([]*rpc.Message, int64, error)
+	// SaveGroup save single group msg.
+	SaveGroup(gid uint, msg json.RawMessage, mid int64, expire uint) error
+	// AddGroupMember add a subscriber key to the group.
+	AddGroupMember(gid uint, key string) error
+	// DelGroupMember remove a subscriber key from the group.
+	DelGroupMember(gid uint, key string) error
+	// GetGroupMembers get all subscriber keys of the group.
+	GetGroupMembers(gid uint) ([]string, error)
+	// GetGroups get all groups the subscriber key joined.
+	GetGroups(key string) ([]uint, error)
+	// SaveRevoke save the signed token revoke unix time of the key, it
+	// expires after expire seconds, 0 means never.
+	SaveRevoke(key string, t int64, expire uint) error
+	// GetRevoke get the signed token revoke unix time of the key, 0 means not
+	// revoked.
+	GetRevoke(key string) (int64, error)
+}
+
+// groupKey get the group messages stored key.
+func groupKey(gid uint) string {
+	return fmt.Sprintf("%s%d", groupKeyPrefix, gid)
+}
+
+// groupMemberKey get the group members stored key.
+func groupMemberKey(gid uint) string {
+	return fmt.Sprintf("%s%d", groupMemberKeyPrefix, gid)
 }
 
 // InitStorage init the storage type(mysql or redis).
 func InitStorage() error {
-	if Conf.StorageType == RedisStorageType {
+	if Conf().StorageType == RedisStorageType {
 		UseStorage = NewRedisStorage()
-	} else if Conf.StorageType == MySQLStorageType {
+	} else if Conf().StorageType == MySQLStorageType {
 		UseStorage = NewMySQLStorage()
 	} else {
-		log.Error("unknown storage type: \"%s\"", Conf.StorageType)
+		log.Error("unknown storage type: \"%s\"", Conf().StorageType)
 		return ErrStorageType
 	}
 	return nil
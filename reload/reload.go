@@ -0,0 +1,128 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package reload
+
+import (
+	"errors"
+	log "github.com/alecthomas/log4go"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrConfig = errors.New("config must be a struct pointer")
+)
+
+// Reload result
+type Stat struct {
+	Time    int64    `json:"time"`              // reload unixnano
+	Succeed bool     `json:"succeed"`           // reload succeed or not
+	Error   string   `json:"error,omitempty"`   // reload error
+	Applied []string `json:"applied"`           // changed and applied settings
+	Restart []string `json:"restart,omitempty"` // changed but need restart settings
+}
+
+// Config hold a config struct pointer which can be reloaded at runtime, the
+// pointer is replaced atomically, so the readers always get a whole config.
+type Config struct {
+	conf  atomic.Value
+	last  atomic.Value
+	hot   map[string]bool
+	mutex *sync.Mutex
+}
+
+// New new a reloadable config, conf must be a struct pointer, hot is the
+// field names which can be applied at runtime.
+func New(conf interface{}, hot map[string]bool) (*Config, error) {
+	if v := reflect.ValueOf(conf); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil, ErrConfig
+	}
+	c := &Config{hot: hot, mutex: &sync.Mutex{}}
+	c.conf.Store(conf)
+	return c, nil
+}
+
+// Get get the current config struct pointer.
+func (c *Config) Get() interface{} {
+	return c.conf.Load()
+}
+
+// Last get the last reload result, nil if never reloaded.
+func (c *Config) Last() *Stat {
+	s, _ := c.last.Load().(*Stat)
+	return s
+}
+
+// Reload load a new config by load, the changed hot settings are copied to a
+// copy of the current config, the other changed settings are reported need
+// restart. The copy is passed to check before it replaces the current
+// config, a check error aborts the reload. After the replacing, apply is
+// called with the applied settings, check and apply can be nil.
+func (c *Config) Reload(load func() (interface{}, error), check func(conf interface{}) error, apply func(conf interface{}, applied []string) error) *Stat {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := &Stat{Time: time.Now().UnixNano()}
+	defer c.last.Store(res)
+	conf, err := load()
+	if err != nil {
+		log.Error("load config error(%v)", err)
+		res.Error = err.Error()
+		return res
+	}
+	// copy-on-write, only the hot settings are replaced
+	ov, nv := reflect.ValueOf(c.Get()).Elem(), reflect.ValueOf(conf).Elem()
+	cp := reflect.New(ov.Type())
+	cv := cp.Elem()
+	cv.Set(ov)
+	for i := 0; i < nv.NumField(); i++ {
+		name := nv.Type().Field(i).Name
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if !c.hot[name] {
+			log.Warn("config \"%s\" changed, need restart", name)
+			res.Restart = append(res.Restart, name)
+			continue
+		}
+		cv.Field(i).Set(nv.Field(i))
+		res.Applied = append(res.Applied, name)
+	}
+	nc := cp.Interface()
+	if check != nil {
+		if err = check(nc); err != nil {
+			log.Error("check config error(%v), reload aborted", err)
+			res.Error = err.Error()
+			res.Applied = nil
+			return res
+		}
+	}
+	c.conf.Store(nc)
+	for _, name := range res.Applied {
+		log.Info("config \"%s\" reloaded", name)
+	}
+	if apply != nil {
+		if err = apply(nc, res.Applied); err != nil {
+			log.Error("apply config error(%v)", err)
+			res.Error = err.Error()
+			return res
+		}
+	}
+	res.Succeed = true
+	return res
+}
@@ -0,0 +1,60 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package reload
+
+import (
+	"errors"
+	"testing"
+)
+
+type testConfig struct {
+	Hot  int
+	Cold string
+}
+
+func TestReload(t *testing.T) {
+	if _, err := New(testConfig{}, nil); err != ErrConfig {
+		t.Errorf("New() error(%v)", err)
+	}
+	c, err := New(&testConfig{Hot: 1, Cold: "a"}, map[string]bool{"Hot": true})
+	if err != nil {
+		t.Fatalf("New() error(%v)", err)
+	}
+	load := func() (interface{}, error) {
+		return &testConfig{Hot: 2, Cold: "b"}, nil
+	}
+	// check failed, nothing replaced
+	res := c.Reload(load, func(interface{}) error { return errors.New("bad") }, nil)
+	if res.Succeed || len(res.Applied) != 0 || c.Get().(*testConfig).Hot != 1 {
+		t.Fatalf("reload %v, config %v", res, c.Get())
+	}
+	applied := []string{}
+	res = c.Reload(load, nil, func(conf interface{}, names []string) error {
+		applied = names
+		return nil
+	})
+	conf := c.Get().(*testConfig)
+	if !res.Succeed || conf.Hot != 2 || conf.Cold != "a" {
+		t.Fatalf("reload %v, config %v", res, conf)
+	}
+	if len(applied) != 1 || applied[0] != "Hot" || len(res.Restart) != 1 || res.Restart[0] != "Cold" {
+		t.Errorf("applied %v, restart %v", applied, res.Restart)
+	}
+	if c.Last() != res {
+		t.Error("last reload result not updated")
+	}
+}
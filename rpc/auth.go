@@ -0,0 +1,54 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"time"
+)
+
+const (
+	AuthService       = "AuthRPC"
+	AuthServiceVerify = "AuthRPC.Verify"
+)
+
+var (
+	// External auth rpc, the backend must implement the "AuthRPC.Verify" and
+	// "AuthRPC.Ping" methods.
+	AuthRPC *RandLB
+)
+
+func init() {
+	AuthRPC, _ = NewRandLB(map[string]*WeightRpc{}, AuthService, 0, 0, false)
+}
+
+// Auth Verify args, also the json body of the http verifier
+type AuthArgs struct {
+	Key   string `json:"key"`   // subscriber key
+	Token string `json:"token"` // subscriber token
+	Node  string `json:"node"`  // comet node
+}
+
+// Auth Verify reply, also the json body replied by the http verifier
+type AuthReply struct {
+	Ok    bool              `json:"ok"`    // authorized or not
+	Attrs map[string]string `json:"attrs"` // connection attributes, eg: user id, device type
+}
+
+// InitAuth init a rand lb rpc for the external auth verifier.
+func InitAuth(addrs []string, retry, ping time.Duration) {
+	AuthRPC = newSinkLB(addrs, AuthService, retry, ping)
+}
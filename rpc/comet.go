@@ -26,15 +26,30 @@ import (
 	"net/rpc"
 	"path"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
 	cometService             = "CometRPC"
+	CometServiceNew          = "CometRPC.New"
+	CometServiceNews         = "CometRPC.News"
+	CometServiceClose        = "CometRPC.Close"
+	CometServiceCloses       = "CometRPC.Closes"
+	CometServiceOnline       = "CometRPC.Online"
+	CometServiceKick         = "CometRPC.Kick"
 	CometServicePushPrivate  = "CometRPC.PushPrivate"
 	CometServicePushPrivates = "CometRPC.PushPrivates"
+	CometServicePushPublic   = "CometRPC.PushPublic"
+	CometServicePushGroup    = "CometRPC.PushGroup"
+	CometServicePublishTopic = "CometRPC.PublishTopic"
 	CometServiceMigrate      = "CometRPC.Migrate"
+	CometServiceDrain        = "CometRPC.Drain"
+	// topic format, shared by comet and web
+	TopicSpliter   = "."
+	TopicWildcard  = "*"
+	MaxTopicLength = 128
 )
 
 var (
@@ -48,11 +63,16 @@ var (
 
 // CometNodeData stored in zookeeper
 type CometNodeInfo struct {
-	RpcAddr []string `json:"rpc"`
-	TcpAddr []string `json:"tcp"`
-	WsAddr  []string `json:"ws"`
-	Weight  int      `json:"weight"`
-	Rpc     *RandLB  `json:"-"`
+	RpcAddr      []string `json:"rpc"`
+	TcpAddr      []string `json:"tcp"`
+	WsAddr       []string `json:"ws"`
+	TlsAddr      []string `json:"tls"`
+	WssAddr      []string `json:"wss"`
+	Tcp2Addr     []string `json:"tcp2"`
+	SseAddr      []string `json:"sse"`
+	LongPollAddr []string `json:"longpoll"`
+	Weight       int      `json:"weight"`
+	Rpc          *RandLB  `json:"-"`
 }
 
 type CometNodeEvent struct {
@@ -85,13 +105,59 @@ type CometPushPrivatesResp struct {
 
 // Channel Push Public Message Args
 type CometPushPublicArgs struct {
-	MsgID int64  // message id
-	Msg   string // message content
+	MsgId  int64           // message id
+	Msg    json.RawMessage // message content
+	Expire uint            // message expire second, 0 means not stored
+}
+
+// Channel Push Group Message Args
+type CometPushGroupArgs struct {
+	Keys    []string        // group member keys
+	GroupId uint            // group id
+	MsgId   int64           // message id
+	Msg     json.RawMessage // message content
+	Expire  uint            // message expire second, 0 means not stored
+}
+
+// Channel Publish Topic Message Args
+type CometPublishTopicArgs struct {
+	Topic string          // topic
+	Msg   json.RawMessage // message content
+}
+
+// ValidTopic check the topic or pattern format, a topic is split by
+// TopicSpliter into non-empty segments, only a pattern can have the segments
+// of a single TopicWildcard.
+func ValidTopic(topic string, pattern bool) bool {
+	if topic == "" || len(topic) > MaxTopicLength {
+		return false
+	}
+	for _, seg := range strings.Split(topic, TopicSpliter) {
+		if seg == "" {
+			return false
+		}
+		if strings.Contains(seg, TopicWildcard) && (!pattern || seg != TopicWildcard) {
+			return false
+		}
+	}
+	return true
 }
 
 // Channel Migrate Args
 type CometMigrateArgs struct {
-	Nodes map[string]int // current comet nodes
+	Nodes map[string]int            // current comet nodes
+	Addrs map[string]*CometNodeAddr // current comet nodes client addresses
+}
+
+// Comet node client addresses, used for redirecting the migrated clients
+type CometNodeAddr struct {
+	TcpAddr      []string // tcp addresses
+	WsAddr       []string // websocket addresses
+	TlsAddr      []string // tcp tls addresses
+	WssAddr      []string // websocket tls addresses
+	Tcp2Addr     []string // tcp binary protocol (v2) addresses
+	SseAddr      []string // sse addresses
+	LongPollAddr []string // long-poll addresses
 }
 
 // Channel New Args
@@ -101,6 +167,34 @@ type CometNewArgs struct {
 	Key    string // subscriber key
 }
 
+// Channel New multi Args
+type CometNewsArgs struct {
+	Tokens map[string]string // subscriber key -> auth token
+}
+
+// Channel Kick Args
+type CometKickArgs struct {
+	Key    string // subscriber key
+	Reason string // kick reason sent to the client, single line
+	Revoke bool   // revoke the registered tokens
+}
+
+// Channel batch operation response
+type CometBatchResp struct {
+	FKeys []string // failed subscriber keys
+}
+
+// Channel Online response
+type CometOnlineResp struct {
+	Keys map[string]*CometOnline // subscriber key -> online info
+}
+
+// Online info of a subscriber key
+type CometOnline struct {
+	Conn  int            `json:"conn"`  // connection count, 0 means offline
+	Proto map[string]int `json:"proto"` // connection count per protocol
+}
+
 // watchCometRoot watch the gopush root node for detecting the node add/del.
 func watchCometRoot(conn *zk.Conn, fpath string, ch chan *CometNodeEvent) error {
 	for {
@@ -217,6 +311,13 @@ func notifyMigrate(conn *zk.Conn, migrateLockPath, znode, key string, update boo
 		log.Error("conn.Create(\"/gopush-migrate-lock\", \"1\", zk.FlagEphemeral) error(%v)", err)
 		return
 	}
+	// the migrated clients will be redirected to the new node
+	addrs := make(map[string]*CometNodeAddr, len(cometNodeInfoMap))
+	for node, info := range cometNodeInfoMap {
+		if info != nil {
+			addrs[node] = &CometNodeAddr{TcpAddr: info.TcpAddr, WsAddr: info.WsAddr, TlsAddr: info.TlsAddr, WssAddr: info.WssAddr, Tcp2Addr: info.Tcp2Addr, SseAddr: info.SseAddr, LongPollAddr: info.LongPollAddr}
+		}
+	}
 	// call comet migrate rpc
 	wg := &sync.WaitGroup{}
 	wg.Add(len(cometNodeInfoMap))
@@ -234,7 +335,7 @@ func notifyMigrate(conn *zk.Conn, migrateLockPath, znode, key string, update boo
 				return
 			}
 			reply := 0
-			args := &CometMigrateArgs{Nodes: nodeWeightMap}
+			args := &CometMigrateArgs{Nodes: nodeWeightMap, Addrs: addrs}
 			if err = r.Call(CometServiceMigrate, args, &reply); err != nil {
 				log.Error("rpc.Call(\"%s\") error(%v)", CometServiceMigrate, err)
 				wg.Done()
@@ -293,9 +394,20 @@ func watchCometNode(conn *zk.Conn, node, fpath string, retry, ping time.Duration
 			// update node info
 			ch <- &CometNodeEvent{Event: eventNodeUpdate, Key: node, Value: info}
 		}
+		// watch the leader node data, the comet may update it when reloading
+		// config, eg: weight changed
+		leader := path.Join(fpath, nodes[0])
+		_, _, dataWatch, err := conn.GetW(leader)
+		if err != nil {
+			log.Error("zk.GetW(\"%s\") error(%v)", leader, err)
+		}
 		// blocking receive event
-		event := <-watch
-		log.Info("zk path: \"%s\" receive a event: (%v)", fpath, event)
+		select {
+		case event := <-watch:
+			log.Info("zk path: \"%s\" receive a event: (%v)", fpath, event)
+		case event := <-dataWatch:
+			log.Info("zk path: \"%s\" receive a data event: (%v)", leader, event)
+		}
 	}
 	// WARN, if no persistence node and comet rpc not config
 	log.Warn("zk path: \"%s\" never watch again till recreate", fpath)
@@ -365,6 +477,11 @@ func GetComet(key string) *CometNodeInfo {
 	return cometNodeInfoMap[node]
 }
 
+// GetComets get all the comet nodes infomation.
+func GetComets() map[string]*CometNodeInfo {
+	return cometNodeInfoMap
+}
+
 // InitComet init a rand lb rpc for comet module.
 func InitComet(conn *zk.Conn, migrateLockPath, fpath string, retry, ping time.Duration) {
 	// watch comet path
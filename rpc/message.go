@@ -31,11 +31,24 @@ const (
 	PrivateGroupId = 0
 	PublicGroupId  = 1
 	// message rpc service
-	MessageService             = "MessageRPC"
-	MessageServiceGetPrivate   = "MessageRPC.GetPrivate"
-	MessageServiceSavePrivate  = "MessageRPC.SavePrivate"
-	MessageServiceSavePrivates = "MessageRPC.SavePrivates"
-	MessageServiceDelPrivate   = "MessageRPC.DelPrivate"
+	MessageService              = "MessageRPC"
+	MessageServiceGetPrivate    = "MessageRPC.GetPrivate"
+	MessageServiceGetPrivateSeq = "MessageRPC.GetPrivateSeq"
+	MessageServiceSavePrivate   = "MessageRPC.SavePrivate"
+	MessageServiceSavePrivates  = "MessageRPC.SavePrivates"
+	MessageServiceDelPrivate    = "MessageRPC.DelPrivate"
+	MessageServiceAckPrivate    = "MessageRPC.AckPrivate"
+	MessageServiceSavePublic    = "MessageRPC.SavePublic"
+	MessageServiceGetPublic     = "MessageRPC.GetPublic"
+	MessageServiceSaveGroup     = "MessageRPC.SaveGroup"
+	MessageServiceGetGroup      = "MessageRPC.GetGroup"
+	// group member rpc service
+	MessageServiceAddGroupMember  = "MessageRPC.AddGroupMember"
+	MessageServiceDelGroupMember  = "MessageRPC.DelGroupMember"
+	MessageServiceGetGroupMembers = "MessageRPC.GetGroupMembers"
+	// signed token revocation rpc service
+	MessageServiceSaveRevoke = "MessageRPC.SaveRevoke"
+	MessageServiceGetRevoke  = "MessageRPC.GetRevoke"
 )
 
 var (
@@ -60,9 +73,12 @@ type MessageNodeInfo struct {
 
 // The Message struct
 type Message struct {
-	Msg     json.RawMessage `json:"msg"` // message content
-	MsgId   int64           `json:"mid"` // message id
-	GroupId uint            `json:"gid"` // group id
+	Msg     json.RawMessage `json:"msg"`             // message content
+	MsgId   int64           `json:"mid"`             // message id
+	Seq     int64           `json:"seq,omitempty"`   // per key sequence, only for stored private message
+	GroupId uint            `json:"gid"`             // group id
+	Topic   string          `json:"topic,omitempty"` // topic, only for topic message
+	Stored  bool            `json:"-"`               // already in the offline storage, only used by comet
 }
 
 // The Old Message struct (Compatible), TODO remove it.
@@ -111,25 +127,82 @@ type MessageSavePrivatesArgs struct {
 
 // Message SavePrivates response
 type MessageSavePrivatesResp struct {
-	FKeys []string // failed key
+	FKeys []string         // failed key
+	Seqs  map[string]int64 // message sequence of the succeed keys
 }
 
-// Message SavePublish args
-type MessageSavePublishArgs struct {
-	MsgID  int64  // message id
-	Msg    string // message content
-	Expire int64  // message expire second
+// Message AckPrivate args
+type MessageAckPrivateArgs struct {
+	Key   string // subscriber key
+	MsgId int64  // acked message id
+}
+
+// Message SavePublic args
+type MessageSavePublicArgs struct {
+	Msg    json.RawMessage // message content
+	MsgId  int64           // message id
+	Expire uint            // message expire second
 }
 
 // Message Get args
 type MessageGetPrivateArgs struct {
-	MsgId int64  // message id
+	MsgId int64  // message id, the cursor of the page
+	Key   string // subscriber key
+	Limit int    // max messages of the page, 0 means no limit
+}
+
+// Message GetPrivateSeq args
+type MessageGetPrivateSeqArgs struct {
+	Key   string // subscriber key
+	From  int64  // first sequence, inclusive, the cursor of the page
+	To    int64  // last sequence, inclusive, 0 means the latest
+	Limit int    // max messages of the page, 0 means no limit
+}
+
+// Message GetPublic args
+type MessageGetPublicArgs struct {
+	MsgId int64 // message id, the cursor of the page
+	Limit int   // max messages of the page, 0 means no limit
+}
+
+// Message SaveGroup args
+type MessageSaveGroupArgs struct {
+	GroupId uint            // group id
+	Msg     json.RawMessage // message content
+	MsgId   int64           // message id
+	Expire  uint            // message expire second
+}
+
+// Message GetGroup args
+type MessageGetGroupArgs struct {
+	MsgId int64  // message id, the cursor of the page
 	Key   string // subscriber key
+	Limit int    // max messages of the page, 0 means no limit
+}
+
+// Message AddGroupMember and DelGroupMember args
+type MessageGroupMemberArgs struct {
+	GroupId uint   // group id
+	Key     string // subscriber key
+}
+
+// Message SaveRevoke args
+type MessageSaveRevokeArgs struct {
+	Key    string // subscriber key
+	Time   int64  // revoke unix time, the signed tokens issued before are rejected
+	Expire uint   // revocation expire second, 0 means never
+}
+
+// Message GetGroupMembers response
+type MessageGetGroupMembersResp struct {
+	Keys []string // subscriber keys
 }
 
 // Message Get Response
 type MessageGetResp struct {
-	Msgs []*Message // messages
+	Msgs    []*Message // messages
+	HasMore bool       // more messages after the page
+	Cursor  int64      // the cursor of the next page, only if HasMore
 }
 
 // watchMessageRoot watch the message root path.
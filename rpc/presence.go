@@ -0,0 +1,63 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"time"
+)
+
+const (
+	PresenceService        = "PresenceRPC"
+	PresenceServiceReceive = "PresenceRPC.Receive"
+	// presence event types
+	PresenceOnline  = "online"
+	PresenceOffline = "offline"
+)
+
+var (
+	// Presence sink rpc, the backend must implement the
+	// "PresenceRPC.Receive" and "PresenceRPC.Ping" methods.
+	PresenceRPC *RandLB
+)
+
+func init() {
+	PresenceRPC, _ = NewRandLB(map[string]*WeightRpc{}, PresenceService, 0, 0, false)
+}
+
+// Presence event, emitted when a connection added or removed
+type PresenceEvent struct {
+	Type  string `json:"type"`  // "online" or "offline"
+	Key   string `json:"key"`   // subscriber key
+	Node  string `json:"node"`  // comet node
+	Proto string `json:"proto"` // connection protocol
+	Addr  string `json:"addr"`  // connection remote address
+	Time  int64  `json:"ts"`    // event unixnano
+	First bool   `json:"first"` // the first connection of the key, only for "online"
+	Last  bool   `json:"last"`  // the last connection of the key, only for "offline"
+	// the connection attributes got by the external auth, eg: user id
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// Presence Receive args, a batch of events in order
+type PresenceArgs struct {
+	Events []*PresenceEvent
+}
+
+// InitPresence init a rand lb rpc for the presence sink.
+func InitPresence(addrs []string, retry, ping time.Duration) {
+	PresenceRPC = newSinkLB(addrs, PresenceService, retry, ping)
+}
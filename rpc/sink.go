@@ -0,0 +1,52 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	log "github.com/alecthomas/log4go"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+// newSinkLB new a rand lb rpc for the sink service, the backend must
+// implement the "Ping" method. the addrs are dialed lazily: an unreachable
+// addr does not fail the init, its calls fail until the rand lb retry
+// goroutine reconnects it.
+func newSinkLB(addrs []string, service string, retry, ping time.Duration) *RandLB {
+	clients := make(map[string]*WeightRpc, len(addrs))
+	for _, addr := range addrs {
+		r, err := rpc.Dial("tcp", addr)
+		if err != nil {
+			log.Warn("rpc.Dial(\"tcp\", \"%s\") error(%v), retry later", addr, err)
+			r = shutdownClient()
+		} else {
+			log.Info("%s rpc addr:\"%s\" connected", service, addr)
+		}
+		clients[addr] = &WeightRpc{Client: r, Addr: addr, Weight: 1}
+	}
+	r, _ := NewRandLB(clients, service, retry, ping, true)
+	return r
+}
+
+// shutdownClient return a rpc client which is already shutdown, every call
+// fails with rpc.ErrShutdown, so the rand lb ping goroutine retries it.
+func shutdownClient() *rpc.Client {
+	c, s := net.Pipe()
+	s.Close()
+	return rpc.NewClient(c)
+}
@@ -0,0 +1,52 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	UpstreamService        = "UpstreamRPC"
+	UpstreamServiceReceive = "UpstreamRPC.Receive"
+)
+
+var (
+	// Upstream sink rpc, the backend must implement the "UpstreamRPC.Receive"
+	// and "UpstreamRPC.Ping" methods.
+	UpstreamRPC *RandLB
+)
+
+func init() {
+	UpstreamRPC, _ = NewRandLB(map[string]*WeightRpc{}, UpstreamService, 0, 0, false)
+}
+
+// Upstream Receive args, the client command forwarded by comet
+type UpstreamArgs struct {
+	Key   string          // subscriber key
+	Node  string          // comet node
+	Cmd   string          // command: "pub", "ack", "unsub" or "token"
+	Msg   json.RawMessage // message content, only for "pub"
+	MsgId int64           // message id, only for "ack"
+	Token string          // new token, only for "token"
+}
+
+// InitUpstream init a rand lb rpc for the upstream sink.
+func InitUpstream(addrs []string, retry, ping time.Duration) {
+	UpstreamRPC = newSinkLB(addrs, UpstreamService, retry, ping)
+}
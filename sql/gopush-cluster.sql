@@ -9,12 +9,25 @@ CREATE TABLE IF NOT EXISTS private_msg (
 	id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY, # auto increment id
 	skey varchar(64) NOT NULL, # subscriber key
 	mid bigint unsigned NOT NULL, # message id
+	seq bigint unsigned NOT NULL DEFAULT 0, # message sequence of the subscriber key
 	ttl bigint NOT NULL, # message expire second
 	msg blob NOT NULL, # message content
 	ctime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # create time
 	mtime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # modify time
 	UNIQUE KEY ux_private_msg_1 (skey, mid),
-	INDEX ix_private_msg_1 (ttl)
+	INDEX ix_private_msg_1 (ttl),
+	INDEX ix_private_msg_2 (skey, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+# upgrade from the old version
+# ALTER TABLE private_msg ADD COLUMN seq bigint unsigned NOT NULL DEFAULT 0 AFTER mid, ADD INDEX ix_private_msg_2 (skey, seq);
+
+# private message sequence
+# DROP TABLE private_seq;
+CREATE TABLE IF NOT EXISTS private_seq (
+	skey varchar(64) NOT NULL PRIMARY KEY, # subscriber key
+	seq bigint unsigned NOT NULL, # last message sequence
+	ctime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # create time
+	mtime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00' # modify time
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
 # public message
@@ -48,4 +61,25 @@ CREATE TABLE IF NOT EXISTS group_msg (
 	mtime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # modify time
 	UNIQUE KEY ux_group_msg_1 (gid, mid),
 	INDEX ix_group_msg_1 (ttl)
-) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+# group member
+# DROP TABLE group_member;
+CREATE TABLE IF NOT EXISTS group_member (
+	id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY, # auto increment id
+	gid int unsigned NOT NULL, # group id
+	skey varchar(64) NOT NULL, # subscriber key
+	ctime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # create time
+	mtime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # modify time
+	UNIQUE KEY ux_group_member_1 (gid, skey),
+	INDEX ix_group_member_1 (skey)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+# signed token revocation
+# DROP TABLE token_revoke;
+CREATE TABLE IF NOT EXISTS token_revoke (
+	skey varchar(64) NOT NULL PRIMARY KEY, # subscriber key
+	rtime bigint NOT NULL, # revoke unix time
+	ttl bigint NOT NULL, # revocation expire second
+	ctime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # create time
+	mtime timestamp NOT NULL DEFAULT '0000-00-00 00:00:00', # modify time
+	INDEX ix_token_revoke_1 (ttl)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -19,12 +19,14 @@ package main
 import (
 	log "github.com/alecthomas/log4go"
 	"encoding/json"
+	"github.com/Terry-Mao/gopush-cluster/id"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -159,6 +161,343 @@ func PushMultiPrivate(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// PushPublic handle for push public message to all the comet nodes.
+func PushPublic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params := r.URL.Query()
+	expire, err := strconv.ParseUint(params.Get("expire"), 10, 32)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", params.Get("expire"), err)
+		return
+	}
+	rm := json.RawMessage(bodyBytes)
+	msg, err := rm.MarshalJSON()
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("json.RawMessage(\"%s\").MarshalJSON() error(%v)", body, err)
+		return
+	}
+	nodes := myrpc.GetComets()
+	if len(nodes) == 0 {
+		res["ret"] = NotFoundServer
+		return
+	}
+	mid := id.Get()
+	// public message need persistence
+	// if message expired no need persistence, only send online message
+	if expire > 0 {
+		client := myrpc.MessageRPC.Get()
+		if client == nil {
+			log.Error("no message node found")
+			res["ret"] = InternalErr
+			return
+		}
+		args := &myrpc.MessageSavePublicArgs{Msg: json.RawMessage(msg), MsgId: mid, Expire: uint(expire)}
+		ret := 0
+		if err := client.Call(myrpc.MessageServiceSavePublic, args, &ret); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSavePublic, args, err)
+			res["ret"] = InternalErr
+			return
+		}
+	}
+	// push to every node
+	args := &myrpc.CometPushPublicArgs{MsgId: mid, Msg: json.RawMessage(msg), Expire: uint(expire)}
+	if fNodes := broadcast(nodes, myrpc.CometServicePushPublic, args); len(fNodes) != 0 {
+		res["data"] = map[string]interface{}{"fn": fNodes}
+	}
+	return
+}
+
+// PushTopic handle for push message to the topic subscribers on all the comet
+// nodes, the topic message is not stored.
+func PushTopic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	topic := r.URL.Query().Get("topic")
+	// publish to a pattern is not allowed
+	if !myrpc.ValidTopic(topic, false) {
+		res["ret"] = ParamErr
+		log.Error("topic:\"%s\" param error", topic)
+		return
+	}
+	rm := json.RawMessage(bodyBytes)
+	msg, err := rm.MarshalJSON()
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("json.RawMessage(\"%s\").MarshalJSON() error(%v)", body, err)
+		return
+	}
+	nodes := myrpc.GetComets()
+	if len(nodes) == 0 {
+		res["ret"] = NotFoundServer
+		return
+	}
+	// push to every node
+	args := &myrpc.CometPublishTopicArgs{Topic: topic, Msg: json.RawMessage(msg)}
+	if fNodes := broadcast(nodes, myrpc.CometServicePublishTopic, args); len(fNodes) != 0 {
+		res["data"] = map[string]interface{}{"fn": fNodes}
+	}
+	return
+}
+
+// broadcast call the method on every comet node in parallel, return the
+// failed nodes.
+func broadcast(nodes map[string]*myrpc.CometNodeInfo, method string, args interface{}) []string {
+	var (
+		fNodes []string
+		mutex  = &sync.Mutex{}
+		wg     = &sync.WaitGroup{}
+	)
+	wg.Add(len(nodes))
+	for node, nodeInfo := range nodes {
+		go func(n string, info *myrpc.CometNodeInfo) {
+			defer wg.Done()
+			if err := callComet(info, method, args); err != nil {
+				log.Error("call \"%s\" to node:%s error(%v)", method, n, err)
+				mutex.Lock()
+				fNodes = append(fNodes, n)
+				mutex.Unlock()
+			}
+		}(node, nodeInfo)
+	}
+	wg.Wait()
+	return fNodes
+}
+
+// callComet call the comet node rpc method.
+func callComet(info *myrpc.CometNodeInfo, method string, args interface{}) error {
+	ret := 0
+	return callCometResp(info, method, args, &ret)
+}
+
+// callCometResp call the comet node rpc method with the reply.
+func callCometResp(info *myrpc.CometNodeInfo, method string, args interface{}, reply interface{}) error {
+	if info == nil || info.Rpc == nil {
+		return myrpc.ErrCometRPC
+	}
+	client := info.Rpc.Get()
+	if client == nil {
+		return myrpc.ErrCometRPC
+	}
+	return client.Call(method, args, reply)
+}
+
+// PushGroup handle for push group message to the group members.
+func PushGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params := r.URL.Query()
+	gid, ret := parseGroupId(params.Get("gid"))
+	if ret != OK {
+		res["ret"] = ret
+		return
+	}
+	expire, err := strconv.ParseUint(params.Get("expire"), 10, 32)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", params.Get("expire"), err)
+		return
+	}
+	rm := json.RawMessage(bodyBytes)
+	msg, err := rm.MarshalJSON()
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("json.RawMessage(\"%s\").MarshalJSON() error(%v)", body, err)
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	// get group members
+	members := &myrpc.MessageGetGroupMembersResp{}
+	if err := client.Call(myrpc.MessageServiceGetGroupMembers, gid, members); err != nil {
+		log.Error("client.Call(\"%s\", %d, members) error(%v)", myrpc.MessageServiceGetGroupMembers, gid, err)
+		res["ret"] = InternalErr
+		return
+	}
+	mid := id.Get()
+	// group message need persistence
+	// if message expired no need persistence, only send online message
+	if expire > 0 {
+		args := &myrpc.MessageSaveGroupArgs{GroupId: gid, Msg: json.RawMessage(msg), MsgId: mid, Expire: uint(expire)}
+		ret := 0
+		if err := client.Call(myrpc.MessageServiceSaveGroup, args, &ret); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.MessageServiceSaveGroup, args, err)
+			res["ret"] = InternalErr
+			return
+		}
+	}
+	// match nodes, members without a comet node are reported as failed
+	nodes, fKeys := groupKeys(members.Keys)
+	// push to every node
+	for cometInfo, ks := range nodes {
+		client := cometInfo.Rpc.Get()
+		if client == nil {
+			log.Error("cannot get comet rpc client")
+			fKeys = append(fKeys, ks...)
+			continue
+		}
+		args := &myrpc.CometPushGroupArgs{Keys: ks, GroupId: gid, MsgId: mid, Msg: json.RawMessage(msg), Expire: uint(expire)}
+		ret := 0
+		if err := client.Call(myrpc.CometServicePushGroup, args, &ret); err != nil {
+			log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", myrpc.CometServicePushGroup, args.Keys, err)
+			fKeys = append(fKeys, ks...)
+			continue
+		}
+	}
+	if len(fKeys) != 0 {
+		res["data"] = map[string]interface{}{"fk": fKeys}
+	}
+	return
+}
+
+// AddGroupMember handle for add a subscriber key to the group.
+func AddGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupMember(w, r, myrpc.MessageServiceAddGroupMember)
+}
+
+// DelGroupMember handle for remove a subscriber key from the group.
+func DelGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupMember(w, r, myrpc.MessageServiceDelGroupMember)
+}
+
+// groupMember call the specified group member rpc method.
+func groupMember(w http.ResponseWriter, r *http.Request, method string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	gid, ret := parseGroupId(params.Get("gid"))
+	if ret != OK {
+		res["ret"] = ret
+		return
+	}
+	key := params.Get("key")
+	if key == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Warn("user_key: \"%s\" can't not find message rpc node", key)
+		res["ret"] = InternalErr
+		return
+	}
+	args := &myrpc.MessageGroupMemberArgs{GroupId: gid, Key: key}
+	reply := 0
+	if err := client.Call(method, args, &reply); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &reply) error(%v)", method, args, err)
+		res["ret"] = InternalErr
+		return
+	}
+	return
+}
+
+// GetGroupMembers handle for get all the subscriber keys of the group.
+func GetGroupMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, "", time.Now())
+	gid, ret := parseGroupId(params.Get("gid"))
+	if ret != OK {
+		res["ret"] = ret
+		return
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	reply := &myrpc.MessageGetGroupMembersResp{}
+	if err := client.Call(myrpc.MessageServiceGetGroupMembers, gid, reply); err != nil {
+		log.Error("client.Call(\"%s\", %d, reply) error(%v)", myrpc.MessageServiceGetGroupMembers, gid, err)
+		res["ret"] = InternalErr
+		return
+	}
+	res["data"] = map[string]interface{}{"keys": reply.Keys}
+	return
+}
+
+// parseGroupId parse the group id, the private and public group id are reserved.
+func parseGroupId(gidStr string) (uint, int) {
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		log.Error("strconv.ParseUint(\"%s\", 10, 32) error(%v)", gidStr, err)
+		return 0, ParamErr
+	}
+	if gid <= myrpc.PublicGroupId {
+		log.Warn("group id:%d reserved", gid)
+		return 0, ParamErr
+	}
+	return uint(gid), OK
+}
+
 // parseMultiPrivate gets keys and msg what need to push.
 // body eg: {"m":"push messages json string","k":"key1,key2,key3"}, must be a json.
 // field k join through ','.
@@ -228,3 +567,275 @@ func DelPrivate(w http.ResponseWriter, r *http.Request) {
 	}
 	return
 }
+
+// NewChannel handle for create the channel and register the token on the comet
+// node of the key.
+func NewChannel(w http.ResponseWriter, r *http.Request) {
+	channelAdmin(w, r, myrpc.CometServiceNew)
+}
+
+// CloseChannel handle for close the channel on the comet node of the key.
+func CloseChannel(w http.ResponseWriter, r *http.Request) {
+	channelAdmin(w, r, myrpc.CometServiceClose)
+}
+
+// KickChannel handle for disconnect all the connections of the key, the
+// channel and the offline messages are kept.
+func KickChannel(w http.ResponseWriter, r *http.Request) {
+	channelAdmin(w, r, myrpc.CometServiceKick)
+}
+
+// channelAdmin call the specified channel rpc method on the comet node of the
+// key.
+func channelAdmin(w http.ResponseWriter, r *http.Request, method string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	params, err := url.ParseQuery(body)
+	if err != nil {
+		log.Error("url.ParseQuery(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	key := params.Get("key")
+	if key == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	node := myrpc.GetComet(key)
+	if node == nil || node.Rpc == nil {
+		res["ret"] = NotFoundServer
+		return
+	}
+	var args interface{} = key
+	switch method {
+	case myrpc.CometServiceNew:
+		args = &myrpc.CometNewArgs{Key: key, Token: params.Get("token")}
+	case myrpc.CometServiceKick:
+		reason := params.Get("reason")
+		if strings.ContainsAny(reason, "\r\n") {
+			res["ret"] = ParamErr
+			return
+		}
+		revoke := false
+		if s := params.Get("revoke"); s != "" {
+			if revoke, err = strconv.ParseBool(s); err != nil {
+				log.Error("strconv.ParseBool(\"%s\") error(%v)", s, err)
+				res["ret"] = ParamErr
+				return
+			}
+		}
+		args = &myrpc.CometKickArgs{Key: key, Reason: reason, Revoke: revoke}
+	}
+	if err := callComet(node, method, args); err != nil {
+		log.Error("client.Call(\"%s\", \"%v\", &ret) error(%v)", method, args, err)
+		res["ret"] = InternalErr
+		return
+	}
+	return
+}
+
+// NewChannels handle for create multiple channels and register the tokens,
+// the keys are routed to their comet nodes.
+// body eg: {"key1":"token1","key2":"token2"}, must be a json.
+func NewChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	tokens := map[string]string{}
+	if err := json.Unmarshal(bodyBytes, &tokens); err != nil || len(tokens) == 0 {
+		log.Error("json.Unmarshal(\"%s\") error(%v)", body, err)
+		res["ret"] = ParamErr
+		return
+	}
+	keys := make([]string, 0, len(tokens))
+	for key := range tokens {
+		keys = append(keys, key)
+	}
+	nodes, nKeys := groupKeys(keys)
+	fKeys := batchComet(nodes, func(info *myrpc.CometNodeInfo, ks []string) ([]string, error) {
+		args := &myrpc.CometNewsArgs{Tokens: make(map[string]string, len(ks))}
+		for _, k := range ks {
+			args.Tokens[k] = tokens[k]
+		}
+		resp := &myrpc.CometBatchResp{}
+		err := callCometResp(info, myrpc.CometServiceNews, args, resp)
+		return resp.FKeys, err
+	})
+	fKeys = append(fKeys, nKeys...)
+	if len(fKeys) != 0 {
+		res["data"] = map[string]interface{}{"fk": fKeys}
+	}
+	return
+}
+
+// CloseChannels handle for close multiple channels, the keys are routed to
+// their comet nodes.
+// body eg: {"k":"key1,key2,key3"}, must be a json.
+func CloseChannels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	keys, ret := parseMultiKeys(bodyBytes)
+	if ret != OK {
+		res["ret"] = ret
+		return
+	}
+	nodes, nKeys := groupKeys(keys)
+	fKeys := batchComet(nodes, func(info *myrpc.CometNodeInfo, ks []string) ([]string, error) {
+		resp := &myrpc.CometBatchResp{}
+		err := callCometResp(info, myrpc.CometServiceCloses, ks, resp)
+		return resp.FKeys, err
+	})
+	fKeys = append(fKeys, nKeys...)
+	if len(fKeys) != 0 {
+		res["data"] = map[string]interface{}{"fk": fKeys}
+	}
+	return
+}
+
+// parseMultiKeys get the keys of the batch request.
+// body eg: {"k":"key1,key2,key3"}, must be a json.
+func parseMultiKeys(body []byte) ([]string, int) {
+	b := map[string]string{}
+	if err := json.Unmarshal(body, &b); err != nil {
+		log.Error("json.Unmarshal(\"%s\") error(%v)", string(body), err)
+		return nil, ParamErr
+	}
+	k := b["k"]
+	if k == "" {
+		return nil, ParamErr
+	}
+	return strings.Split(k, ","), OK
+}
+
+// groupKeys group the keys by their comet nodes, the keys without a comet
+// node are returned as failed keys.
+func groupKeys(keys []string) (map[*myrpc.CometNodeInfo][]string, []string) {
+	var (
+		nodes = map[*myrpc.CometNodeInfo][]string{}
+		fKeys []string
+	)
+	for _, key := range keys {
+		node := myrpc.GetComet(key)
+		if node == nil || node.Rpc == nil {
+			log.Warn("user_key: \"%s\" no comet node found", key)
+			fKeys = append(fKeys, key)
+			continue
+		}
+		nodes[node] = append(nodes[node], key)
+	}
+	return nodes, fKeys
+}
+
+// batchComet call the function for every comet node in parallel, return the
+// failed keys, all the keys of the node failed if the call failed.
+func batchComet(nodes map[*myrpc.CometNodeInfo][]string, call func(*myrpc.CometNodeInfo, []string) ([]string, error)) []string {
+	var (
+		fKeys []string
+		mutex = &sync.Mutex{}
+		wg    = &sync.WaitGroup{}
+	)
+	wg.Add(len(nodes))
+	for nodeInfo, keys := range nodes {
+		go func(info *myrpc.CometNodeInfo, ks []string) {
+			defer wg.Done()
+			fks, err := call(info, ks)
+			if err != nil {
+				log.Error("call comet node:%v error(%v)", info.RpcAddr, err)
+				fks = ks
+			}
+			mutex.Lock()
+			fKeys = append(fKeys, fks...)
+			mutex.Unlock()
+		}(nodeInfo, keys)
+	}
+	wg.Wait()
+	return fKeys
+}
+
+// GetOnline handle for get the connection counts and protocols of multiple
+// keys, the keys are routed to their comet nodes and queried in parallel.
+// body eg: {"k":"key1,key2,key3"}, must be a json.
+func GetOnline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	body := ""
+	res := map[string]interface{}{"ret": OK}
+	defer retPWrite(w, r, res, &body, time.Now())
+	// param
+	bodyBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		res["ret"] = InternalErr
+		log.Error("ioutil.ReadAll() failed (%v)", err)
+		return
+	}
+	body = string(bodyBytes)
+	keys, ret := parseMultiKeys(bodyBytes)
+	if ret != OK {
+		res["ret"] = ret
+		return
+	}
+	nodes, nKeys := groupKeys(keys)
+	var (
+		online = make(map[string]*myrpc.CometOnline, len(keys))
+		mutex  = &sync.Mutex{}
+	)
+	fKeys := batchComet(nodes, func(info *myrpc.CometNodeInfo, ks []string) ([]string, error) {
+		resp := &myrpc.CometOnlineResp{}
+		if err := callCometResp(info, myrpc.CometServiceOnline, ks, resp); err != nil {
+			return nil, err
+		}
+		mutex.Lock()
+		for k, o := range resp.Keys {
+			online[k] = o
+		}
+		mutex.Unlock()
+		return nil, nil
+	})
+	fKeys = append(fKeys, nKeys...)
+	data := map[string]interface{}{"keys": online}
+	if len(fKeys) != 0 {
+		data["fk"] = fKeys
+	}
+	res["data"] = data
+	return
+}
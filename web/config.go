@@ -17,15 +17,29 @@
 package main
 
 import (
+	log "github.com/alecthomas/log4go"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"github.com/Terry-Mao/goconf"
+	"github.com/Terry-Mao/gopush-cluster/reload"
 	"runtime"
 	"time"
 )
 
 var (
-	Conf     *Config
+	// the current config, replaced when reloading
+	liveConf *reload.Config
 	confFile string
+	// the settings can be applied at runtime
+	hotConf = map[string]bool{
+		"Log":          true,
+		"TLSCertFile":  true,
+		"TLSKeyFile":   true,
+		"MsgPageLimit": true,
+		"MsgPageMax":   true,
+	}
+	ErrMsgPage = errors.New("msg.page.limit must be in (0, msg.page.max]")
 )
 
 // InitConfig initialize config file path
@@ -36,6 +50,10 @@ func init() {
 type Config struct {
 	HttpBind             []string      `goconf:"base:http.bind:,"`
 	AdminBind            []string      `goconf:"base:admin.bind:,"`
+	HttpTLSBind          []string      `goconf:"base:http.tls.bind:,"`
+	AdminTLSBind         []string      `goconf:"base:admin.tls.bind:,"`
+	TLSCertFile          string        `goconf:"base:tls.cert"`
+	TLSKeyFile           string        `goconf:"base:tls.key"`
 	HttpServerTimeout    time.Duration `goconf:"base:http.servertimeout:time"`
 	MaxProc              int           `goconf:"base:maxproc"`
 	PprofBind            []string      `goconf:"base:pprof.bind:,"`
@@ -48,20 +66,40 @@ type Config struct {
 	ZookeeperCometPath   string        `goconf:"zookeeper:comet.path"`
 	ZookeeperMessagePath string        `goconf:"zookeeper:message.path"`
 	ZookeeperMigratePath string        `goconf:"zookeeper:migrate.path"`
+	ZookeeperIdPath      string        `goconf:"zookeeper:id.path"`
 	RPCRetry             time.Duration `goconf:"rpc:retry:time"`
 	RPCPing              time.Duration `goconf:"rpc:ping:time"`
+	MsgPageLimit         int           `goconf:"msg:page.limit"`
+	MsgPageMax           int           `goconf:"msg:page.max"`
 }
 
 // InitConfig init configuration file.
 func InitConfig() error {
+	c, err := newConfig()
+	if err != nil {
+		return err
+	}
+	liveConf, err = reload.New(c, hotConf)
+	return err
+}
+
+// Conf get the current config, the config must not be modified.
+func Conf() *Config {
+	return liveConf.Get().(*Config)
+}
+
+// newConfig get a new Config struct from the config file.
+func newConfig() (*Config, error) {
 	gconf := goconf.New()
 	if err := gconf.Parse(confFile); err != nil {
-		return err
+		return nil, err
 	}
 	// Default config
-	Conf = &Config{
+	conf := &Config{
 		HttpBind:             []string{"localhost:80"},
 		AdminBind:            []string{"localhost:81"},
+		HttpTLSBind:          []string{},
+		AdminTLSBind:         []string{},
 		HttpServerTimeout:    10 * time.Second,
 		MaxProc:              runtime.NumCPU(),
 		PprofBind:            []string{"localhost:8190"},
@@ -74,11 +112,39 @@ func InitConfig() error {
 		ZookeeperCometPath:   "/gopush-cluster-comet",
 		ZookeeperMessagePath: "/gopush-cluster-message",
 		ZookeeperMigratePath: "/gopush-migrate-lock",
+		ZookeeperIdPath:      "/gopush-cluster-id",
 		RPCRetry:             3 * time.Second,
 		RPCPing:              1 * time.Second,
+		MsgPageLimit:         50,
+		MsgPageMax:           500,
 	}
-	if err := gconf.Unmarshal(Conf); err != nil {
-		return err
+	if err := gconf.Unmarshal(conf); err != nil {
+		return nil, err
 	}
-	return nil
+	if conf.MsgPageLimit <= 0 || conf.MsgPageLimit > conf.MsgPageMax {
+		return nil, ErrMsgPage
+	}
+	return conf, nil
+}
+
+// ReloadConfig re-read the config file and apply the hot settings, the
+// changed settings which can't be applied at runtime are reported in the
+// result.
+func ReloadConfig() *reload.Stat {
+	var cert *tls.Certificate
+	return liveConf.Reload(func() (interface{}, error) {
+		return newConfig()
+	}, func(c interface{}) (err error) {
+		// always re-read the certificate, the files may be replaced in place
+		cert, err = readTLS(c.(*Config))
+		return
+	}, func(c interface{}, applied []string) error {
+		tlsCert.Set(cert)
+		for _, name := range applied {
+			if name == "Log" {
+				log.LoadConfiguration(c.(*Config).Log)
+			}
+		}
+		return nil
+	})
 }
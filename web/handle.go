@@ -18,6 +18,7 @@ package main
 
 import (
 	log "github.com/alecthomas/log4go"
+	"github.com/Terry-Mao/gopush-cluster/id"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	"net/http"
 	"strconv"
@@ -27,6 +28,13 @@ import (
 const (
 	wsProto  = "1"
 	tcpProto = "2"
+	wssProto = "3"
+	tlsProto = "4"
+	// tcp binary protocol (v2)
+	tcp2Proto = "5"
+	// http transports
+	sseProto      = "6"
+	longPollProto = "7"
 )
 
 // getProtoAddr get specified protocol addresss.
@@ -35,6 +43,16 @@ func getProtoAddr(node *myrpc.CometNodeInfo, p string) (addrs []string, ret int)
 		addrs = node.WsAddr
 	} else if p == tcpProto {
 		addrs = node.TcpAddr
+	} else if p == wssProto {
+		addrs = node.WssAddr
+	} else if p == tlsProto {
+		addrs = node.TlsAddr
+	} else if p == tcp2Proto {
+		addrs = node.Tcp2Addr
+	} else if p == sseProto {
+		addrs = node.SseAddr
+	} else if p == longPollProto {
+		addrs = node.LongPollAddr
 	} else {
 		ret = ParamErr
 		return
@@ -100,9 +118,9 @@ func GetOfflineMsg0(w http.ResponseWriter, r *http.Request) {
 		log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", midStr, err)
 		return
 	}
-	// RPC get offline messages
+	// RPC get offline messages, the legacy clients get at most a max page
 	reply := &myrpc.MessageGetResp{}
-	args := &myrpc.MessageGetPrivateArgs{MsgId: mid, Key: key}
+	args := &myrpc.MessageGetPrivateArgs{MsgId: mid, Key: key, Limit: Conf().MsgPageMax}
 	client := myrpc.MessageRPC.Get()
 	if client == nil {
 		res["ret"] = InternalErr
@@ -113,6 +131,14 @@ func GetOfflineMsg0(w http.ResponseWriter, r *http.Request) {
 		res["ret"] = InternalErr
 		return
 	}
+	// RPC get offline public messages
+	preply := &myrpc.MessageGetResp{}
+	pargs := &myrpc.MessageGetPublicArgs{MsgId: mid, Limit: Conf().MsgPageMax}
+	if err := client.Call(myrpc.MessageServiceGetPublic, pargs, preply); err != nil {
+		log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPublic, pargs, err)
+		res["ret"] = InternalErr
+		return
+	}
 	omsgs := []string{}
 	opmsgs := []string{}
 	for _, msg := range reply.Msgs {
@@ -123,8 +149,16 @@ func GetOfflineMsg0(w http.ResponseWriter, r *http.Request) {
 		}
 		omsgs = append(omsgs, string(omsg))
 	}
+	for _, msg := range preply.Msgs {
+		omsg, err := msg.OldBytes()
+		if err != nil {
+			res["ret"] = InternalErr
+			return
+		}
+		opmsgs = append(opmsgs, string(omsg))
+	}
 
-	if len(omsgs) == 0 {
+	if len(omsgs) == 0 && len(opmsgs) == 0 {
 		return
 	}
 
@@ -143,6 +177,6 @@ func GetTime0(w http.ResponseWriter, r *http.Request) {
 	res := map[string]interface{}{"ret": OK, "msg": "ok"}
 	now := time.Now()
 	defer retWrite(w, r, res, callback, now)
-	res["data"] = map[string]interface{}{"timeid": now.UnixNano() / 100}
+	res["data"] = map[string]interface{}{"timeid": id.FromTime(now)}
 	return
 }
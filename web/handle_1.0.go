@@ -18,6 +18,7 @@ package main
 
 import (
 	log "github.com/alecthomas/log4go"
+	"github.com/Terry-Mao/gopush-cluster/id"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	"net/http"
 	"strconv"
@@ -96,6 +97,10 @@ func GetOfflineMsg(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	key := params.Get("k")
 	midStr := params.Get("m")
+	limitStr := params.Get("l")
+	cursorStr := params.Get("c")
+	pcursorStr := params.Get("pc")
+	gcursorStr := params.Get("gc")
 	callback := params.Get("cb")
 	res := map[string]interface{}{"ret": OK}
 	defer retWrite(w, r, res, callback, time.Now())
@@ -109,24 +114,156 @@ func GetOfflineMsg(w http.ResponseWriter, r *http.Request) {
 		log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", midStr, err)
 		return
 	}
+	// the private, public and group messages are paged separately, the
+	// cursor is the mid of the last message of the previous page
+	limit := Conf().MsgPageLimit
+	if limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.Atoi(\"%s\") error(%v)", limitStr, err)
+			return
+		}
+	}
+	if limit == 0 || limit > Conf().MsgPageMax {
+		limit = Conf().MsgPageMax
+	}
+	// the first page gets all, the next pages only get the kinds which
+	// cursor set
+	first := cursorStr == "" && pcursorStr == "" && gcursorStr == ""
+	cursor, pcursor, gcursor := mid, mid, mid
+	for _, c := range []struct {
+		str    string
+		cursor *int64
+	}{{cursorStr, &cursor}, {pcursorStr, &pcursor}, {gcursorStr, &gcursor}} {
+		if c.str == "" {
+			continue
+		}
+		if *c.cursor, err = strconv.ParseInt(c.str, 10, 64); err != nil {
+			res["ret"] = ParamErr
+			log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", c.str, err)
+			return
+		}
+	}
+	client := myrpc.MessageRPC.Get()
+	if client == nil {
+		log.Error("no message node found")
+		res["ret"] = InternalErr
+		return
+	}
+	data := map[string]interface{}{}
+	empty := true
+	// RPC get offline messages
+	if first || cursorStr != "" {
+		reply := &myrpc.MessageGetResp{}
+		args := &myrpc.MessageGetPrivateArgs{MsgId: cursor, Key: key, Limit: limit}
+		if err := client.Call(myrpc.MessageServiceGetPrivate, args, reply); err != nil {
+			log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPrivate, args, err)
+			res["ret"] = InternalErr
+			return
+		}
+		data["msgs"], data["has_more"], data["cursor"] = reply.Msgs, reply.HasMore, reply.Cursor
+		empty = empty && len(reply.Msgs) == 0 && !reply.HasMore
+	}
+	// RPC get offline public messages
+	if first || pcursorStr != "" {
+		preply := &myrpc.MessageGetResp{}
+		pargs := &myrpc.MessageGetPublicArgs{MsgId: pcursor, Limit: limit}
+		if err := client.Call(myrpc.MessageServiceGetPublic, pargs, preply); err != nil {
+			log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPublic, pargs, err)
+			res["ret"] = InternalErr
+			return
+		}
+		data["pmsgs"], data["p_has_more"], data["p_cursor"] = preply.Msgs, preply.HasMore, preply.Cursor
+		empty = empty && len(preply.Msgs) == 0 && !preply.HasMore
+	}
+	// RPC get offline group messages
+	if first || gcursorStr != "" {
+		greply := &myrpc.MessageGetResp{}
+		gargs := &myrpc.MessageGetGroupArgs{MsgId: gcursor, Key: key, Limit: limit}
+		if err := client.Call(myrpc.MessageServiceGetGroup, gargs, greply); err != nil {
+			log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetGroup, gargs, err)
+			res["ret"] = InternalErr
+			return
+		}
+		data["gmsgs"], data["g_has_more"], data["g_cursor"] = greply.Msgs, greply.HasMore, greply.Cursor
+		empty = empty && len(greply.Msgs) == 0 && !greply.HasMore
+	}
+	if empty {
+		return
+	}
+	res["data"] = data
+	return
+}
+
+// GetOfflineMsgSeq get offline private mesage by the sequence range http
+// handler, the client gets the missing messages when it detected a gap.
+func GetOfflineMsgSeq(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	params := r.URL.Query()
+	key := params.Get("k")
+	fromStr := params.Get("f")
+	toStr := params.Get("t")
+	limitStr := params.Get("l")
+	callback := params.Get("cb")
+	res := map[string]interface{}{"ret": OK}
+	defer retWrite(w, r, res, callback, time.Now())
+	if key == "" || fromStr == "" {
+		res["ret"] = ParamErr
+		return
+	}
+	from, err := strconv.ParseInt(fromStr, 10, 64)
+	if err != nil {
+		res["ret"] = ParamErr
+		log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", fromStr, err)
+		return
+	}
+	to := int64(0)
+	if toStr != "" {
+		if to, err = strconv.ParseInt(toStr, 10, 64); err != nil {
+			res["ret"] = ParamErr
+			log.Error("strconv.ParseInt(\"%s\", 10, 64) error(%v)", toStr, err)
+			return
+		}
+	}
+	if from < 0 || to < 0 || (to > 0 && to < from) {
+		res["ret"] = ParamErr
+		return
+	}
+	// the range is paged as the private messages, the next page starts from
+	// the cursor
+	limit := Conf().MsgPageLimit
+	if limitStr != "" {
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 0 {
+			res["ret"] = ParamErr
+			log.Error("strconv.Atoi(\"%s\") error(%v)", limitStr, err)
+			return
+		}
+	}
+	if limit == 0 || limit > Conf().MsgPageMax {
+		limit = Conf().MsgPageMax
+	}
 	// RPC get offline messages
 	reply := &myrpc.MessageGetResp{}
-	args := &myrpc.MessageGetPrivateArgs{MsgId: mid, Key: key}
+	args := &myrpc.MessageGetPrivateSeqArgs{Key: key, From: from, To: to, Limit: limit}
 	client := myrpc.MessageRPC.Get()
 	if client == nil {
 		log.Error("no message node found")
 		res["ret"] = InternalErr
 		return
 	}
-	if err := client.Call(myrpc.MessageServiceGetPrivate, args, reply); err != nil {
-		log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPrivate, args, err)
+	if err := client.Call(myrpc.MessageServiceGetPrivateSeq, args, reply); err != nil {
+		log.Error("myrpc.MessageRPC.Call(\"%s\", \"%v\", reply) error(%v)", myrpc.MessageServiceGetPrivateSeq, args, err)
 		res["ret"] = InternalErr
 		return
 	}
-	if len(reply.Msgs) == 0 {
+	// the expired messages are skipped, so a page may be empty but has more
+	if len(reply.Msgs) == 0 && !reply.HasMore {
 		return
 	}
-	res["data"] = map[string]interface{}{"msgs": reply.Msgs}
+	res["data"] = map[string]interface{}{"msgs": reply.Msgs, "has_more": reply.HasMore, "cursor": reply.Cursor}
 	return
 }
 
@@ -141,6 +278,6 @@ func GetTime(w http.ResponseWriter, r *http.Request) {
 	res := map[string]interface{}{"ret": OK}
 	now := time.Now()
 	defer retWrite(w, r, res, callback, now)
-	res["data"] = map[string]interface{}{"timeid": now.UnixNano() / 100}
+	res["data"] = map[string]interface{}{"timeid": id.FromTime(now)}
 	return
 }
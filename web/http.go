@@ -18,6 +18,7 @@ package main
 
 import (
 	log "github.com/alecthomas/log4go"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -34,6 +35,7 @@ func StartHTTP() {
 	// 1.0
 	httpServeMux.HandleFunc("/1/server/get", GetServer)
 	httpServeMux.HandleFunc("/1/msg/get", GetOfflineMsg)
+	httpServeMux.HandleFunc("/1/msg/seq/get", GetOfflineMsgSeq)
 	httpServeMux.HandleFunc("/1/time/get", GetTime)
 	// old
 	httpServeMux.HandleFunc("/server/get", GetServer0)
@@ -44,34 +46,84 @@ func StartHTTP() {
 	// 1.0
 	httpAdminServeMux.HandleFunc("/1/admin/push/private", PushPrivate)
 	httpAdminServeMux.HandleFunc("/1/admin/push/mprivate", PushMultiPrivate)
+	httpAdminServeMux.HandleFunc("/1/admin/push/public", PushPublic)
+	httpAdminServeMux.HandleFunc("/1/admin/push/group", PushGroup)
+	httpAdminServeMux.HandleFunc("/1/admin/push/topic", PushTopic)
+	httpAdminServeMux.HandleFunc("/1/admin/group/add", AddGroupMember)
+	httpAdminServeMux.HandleFunc("/1/admin/group/del", DelGroupMember)
+	httpAdminServeMux.HandleFunc("/1/admin/group/get", GetGroupMembers)
 	httpAdminServeMux.HandleFunc("/1/admin/msg/del", DelPrivate)
+	httpAdminServeMux.HandleFunc("/1/admin/channel/new", NewChannel)
+	httpAdminServeMux.HandleFunc("/1/admin/channel/mnew", NewChannels)
+	httpAdminServeMux.HandleFunc("/1/admin/channel/close", CloseChannel)
+	httpAdminServeMux.HandleFunc("/1/admin/channel/mclose", CloseChannels)
+	httpAdminServeMux.HandleFunc("/1/admin/channel/kick", KickChannel)
+	httpAdminServeMux.HandleFunc("/1/admin/online/get", GetOnline)
+	httpAdminServeMux.HandleFunc("/1/admin/stat", StatHandle)
 	// old
 	httpAdminServeMux.HandleFunc("/admin/push", PushPrivate)
 	httpAdminServeMux.HandleFunc("/admin/msg/clean", DelPrivate)
-	for _, bind := range Conf.HttpBind {
+	for _, bind := range Conf().HttpBind {
 		log.Info("start http listen addr:\"%s\"", bind)
-		go httpListen(httpServeMux, bind)
+		go httpListen(httpServeMux, bind, false)
 	}
-	for _, bind := range Conf.AdminBind {
+	for _, bind := range Conf().HttpTLSBind {
+		log.Info("start https listen addr:\"%s\"", bind)
+		go httpListen(httpServeMux, bind, true)
+	}
+	for _, bind := range Conf().AdminBind {
 		log.Info("start admin http listen addr:\"%s\"", bind)
-		go httpListen(httpAdminServeMux, bind)
+		go httpListen(httpAdminServeMux, bind, false)
+	}
+	for _, bind := range Conf().AdminTLSBind {
+		log.Info("start admin https listen addr:\"%s\"", bind)
+		go httpListen(httpAdminServeMux, bind, true)
 	}
 }
 
-func httpListen(mux *http.ServeMux, bind string) {
-	server := &http.Server{Handler: mux, ReadTimeout: Conf.HttpServerTimeout, WriteTimeout: Conf.HttpServerTimeout}
+func httpListen(mux *http.ServeMux, bind string, secure bool) {
+	server := &http.Server{Handler: mux, ReadTimeout: Conf().HttpServerTimeout, WriteTimeout: Conf().HttpServerTimeout}
 	server.SetKeepAlivesEnabled(false)
 	l, err := net.Listen("tcp", bind)
 	if err != nil {
 		log.Error("net.Listen(\"tcp\", \"%s\") error(%v)", bind, err)
 		panic(err)
 	}
+	if secure {
+		l = tls.NewListener(l, tlsCert.Config())
+	}
 	if err := server.Serve(l); err != nil {
 		log.Error("server.Serve() error(%v)", err)
 		panic(err)
 	}
 }
 
+// StatHandle get stat info by http.
+func StatHandle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method Not Allowed", 405)
+		return
+	}
+	var res interface{}
+	switch r.URL.Query().Get("type") {
+	case "config":
+		res = Conf()
+	case "reload":
+		res = liveConf.Last()
+	default:
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	data, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		log.Error("json.MarshalIndent(\"%v\", \"\", \"    \") error(%v)", res, err)
+		return
+	}
+	if _, err := w.Write(data); err != nil {
+		log.Error("w.Write(\"%s\") error(%v)", string(data), err)
+	}
+}
+
 // retWrite marshal the result and write to client(get).
 func retWrite(w http.ResponseWriter, r *http.Request, res map[string]interface{}, callback string, start time.Time) {
 	data, err := json.Marshal(res)
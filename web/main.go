@@ -34,9 +34,9 @@ func main() {
 		panic(err)
 	}
 	// Set max routine
-	runtime.GOMAXPROCS(Conf.MaxProc)
+	runtime.GOMAXPROCS(Conf().MaxProc)
 	// init log
-	log.LoadConfiguration(Conf.Log)
+	log.LoadConfiguration(Conf().Log)
 	defer log.Close()
 	// init zookeeper
 	zkConn, err := InitZK()
@@ -47,11 +47,15 @@ func main() {
 		panic(err)
 	}
 	// start pprof http
-	perf.Init(Conf.PprofBind)
+	perf.Init(Conf().PprofBind)
+	// load tls certificate
+	if err = LoadTLS(); err != nil {
+		panic(err)
+	}
 	// start http listen.
 	StartHTTP()
 	// process init
-	if err = process.Init(Conf.User, Conf.Dir, Conf.PidFile); err != nil {
+	if err = process.Init(Conf().User, Conf().Dir, Conf().PidFile); err != nil {
 		panic(err)
 	}
 	// init signals, block wait signals
@@ -0,0 +1,44 @@
+// Copyright © 2014 Terry Mao, LiuDing All rights reserved.
+// This file is part of gopush-cluster.
+
+// gopush-cluster is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// gopush-cluster is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with gopush-cluster.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"github.com/Terry-Mao/gopush-cluster/cert"
+)
+
+var (
+	// the current certificate, replaced when reloading
+	tlsCert = cert.New()
+)
+
+// LoadTLS read the certificate and key files if any tls listener configured,
+// called at startup, the new handshakes use the current certificate.
+func LoadTLS() error {
+	c, err := readTLS(Conf())
+	if err != nil {
+		return err
+	}
+	tlsCert.Set(c)
+	return nil
+}
+
+// readTLS read the certificate and key files of the config, return nil if no
+// tls listener configured.
+func readTLS(conf *Config) (*tls.Certificate, error) {
+	return cert.LoadIf(len(conf.HttpTLSBind) != 0 || len(conf.AdminTLSBind) != 0, conf.TLSCertFile, conf.TLSKeyFile)
+}
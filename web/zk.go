@@ -18,18 +18,29 @@ package main
 
 import (
 	log "github.com/alecthomas/log4go"
+	"github.com/Terry-Mao/gopush-cluster/id"
 	myrpc "github.com/Terry-Mao/gopush-cluster/rpc"
 	myzk "github.com/Terry-Mao/gopush-cluster/zk"
 	"github.com/samuel/go-zookeeper/zk"
 )
 
 func InitZK() (*zk.Conn, error) {
-	conn, err := myzk.Connect(Conf.ZookeeperAddr, Conf.ZookeeperTimeout)
+	conn, err := myzk.Connect(Conf().ZookeeperAddr, Conf().ZookeeperTimeout)
 	if err != nil {
 		log.Error("zk.Connect() error(%v)", err)
 		return nil, err
 	}
-	myrpc.InitComet(conn, Conf.ZookeeperMigratePath, Conf.ZookeeperCometPath, Conf.RPCRetry, Conf.RPCPing)
-	myrpc.InitMessage(conn, Conf.ZookeeperMessagePath, Conf.RPCRetry, Conf.RPCPing)
+	node, err := myzk.RegisterTempId(conn, Conf().ZookeeperIdPath, nil, id.MaxNode)
+	if err != nil {
+		log.Error("myzk.RegisterTempId(\"%s\") error(%v)", Conf().ZookeeperIdPath, err)
+		return conn, err
+	}
+	if err = id.Init(node); err != nil {
+		log.Error("id.Init(%d) error(%v)", node, err)
+		return conn, err
+	}
+	log.Info("message id generator node: %d", node)
+	myrpc.InitComet(conn, Conf().ZookeeperMigratePath, Conf().ZookeeperCometPath, Conf().RPCRetry, Conf().RPCPing)
+	myrpc.InitMessage(conn, Conf().ZookeeperMessagePath, Conf().RPCRetry, Conf().RPCPing)
 	return conn, nil
 }
@@ -26,6 +26,7 @@ import (
 	"github.com/samuel/go-zookeeper/zk"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -35,6 +36,7 @@ var (
 	// error
 	ErrNoChild      = errors.New("zk: children is nil")
 	ErrNodeNotExist = errors.New("zk: node not exist")
+	ErrNoFreeId     = errors.New("zk: no free id")
 )
 
 // Connect connect to zookeeper, and start a goroutine log the event.
@@ -76,33 +78,66 @@ func Create(conn *zk.Conn, fpath string) error {
 
 // RegisterTmp create a ephemeral node, and watch it, if node droped then send a SIGQUIT to self.
 func RegisterTemp(conn *zk.Conn, fpath string, data []byte) error {
+	_, err := RegisterTempNode(conn, fpath, data)
+	return err
+}
+
+// RegisterTempNode is like RegisterTemp, but return the created node path,
+// the caller can update the node data by it.
+func RegisterTempNode(conn *zk.Conn, fpath string, data []byte) (string, error) {
 	tpath, err := conn.Create(path.Join(fpath)+"/", data, zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
 	if err != nil {
 		log.Error("conn.Create(\"%s\", \"%s\", zk.FlagEphemeral|zk.FlagSequence) error(%v)", fpath, string(data), err)
-		return err
+		return "", err
 	}
 	log.Debug("create a zookeeper node:%s", tpath)
 	// watch self
-	go func() {
-		for {
-			log.Info("zk path: \"%s\" set a watch", tpath)
-			exist, _, watch, err := conn.ExistsW(tpath)
-			if err != nil {
-				log.Error("zk.ExistsW(\"%s\") error(%v)", tpath, err)
-				log.Warn("zk path: \"%s\" set watch failed, kill itself", tpath)
-				killSelf()
-				return
-			}
-			if !exist {
-				log.Warn("zk path: \"%s\" not exist, kill itself", tpath)
-				killSelf()
-				return
+	go watchSelf(conn, tpath)
+	return tpath, nil
+}
+
+// RegisterTempId claim a unique id in [0, max] by creating an ephemeral node
+// named by the id under the path, the id is released when the session closed.
+func RegisterTempId(conn *zk.Conn, fpath string, data []byte, max int) (int, error) {
+	if err := Create(conn, fpath); err != nil {
+		log.Error("Create(\"%s\") error(%v)", fpath, err)
+		return 0, err
+	}
+	for id := 0; id <= max; id++ {
+		tpath := path.Join(fpath, strconv.Itoa(id))
+		if _, err := conn.Create(tpath, data, zk.FlagEphemeral, zk.WorldACL(zk.PermAll)); err != nil {
+			if err == zk.ErrNodeExists {
+				continue
 			}
-			event := <-watch
-			log.Info("zk path: \"%s\" receive a event %v", tpath, event)
+			log.Error("conn.Create(\"%s\", \"%s\", zk.FlagEphemeral) error(%v)", tpath, string(data), err)
+			return 0, err
 		}
-	}()
-	return nil
+		log.Debug("create a zookeeper node:%s", tpath)
+		go watchSelf(conn, tpath)
+		return id, nil
+	}
+	return 0, ErrNoFreeId
+}
+
+// watchSelf watch the ephemeral node, kill self if the node is gone.
+func watchSelf(conn *zk.Conn, tpath string) {
+	for {
+		log.Info("zk path: \"%s\" set a watch", tpath)
+		exist, _, watch, err := conn.ExistsW(tpath)
+		if err != nil {
+			log.Error("zk.ExistsW(\"%s\") error(%v)", tpath, err)
+			log.Warn("zk path: \"%s\" set watch failed, kill itself", tpath)
+			killSelf()
+			return
+		}
+		if !exist {
+			log.Warn("zk path: \"%s\" not exist, kill itself", tpath)
+			killSelf()
+			return
+		}
+		event := <-watch
+		log.Info("zk path: \"%s\" receive a event %v", tpath, event)
+	}
 }
 
 // GetNodesW get all child from zk path with a watch.